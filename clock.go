@@ -0,0 +1,187 @@
+package ratelimit
+
+/*
+Copyright (c) Yunpeng Deng(dypflying)
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+import (
+	"sync"
+	"time"
+)
+
+//Clock defines the time source of a rate limiter, the default one is backed by the time package.
+//A rate limiter can be driven by another clock with the WithClock option, e.g. the FakeClock for tests.
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+	NewTimer(d time.Duration) Timer
+}
+
+//MonotonicClock is implemented by the clocks which measure the elapsed time independently of the wall clock,
+//the rate limiters prefer it to the readings of Now(), so the steps of the wall clock do not affect the limits.
+type MonotonicClock interface {
+	Clock
+	//return the time elapsed since an arbitrary fixed point, which never goes back
+	Monotonic() time.Duration
+}
+
+//Timer defines the timer created by a Clock
+type Timer interface {
+	//return the channel on which the current time is delivered when the timer fires
+	C() <-chan time.Time
+	//stop the timer, return false if it has already fired or been stopped
+	Stop() bool
+}
+
+type realClock struct{}
+
+//the fixed point of the monotonic time of the real clock
+var processStart = time.Now()
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) Monotonic() time.Duration {
+	return time.Since(processStart)
+}
+
+func (realClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
+
+//FakeClock is a manually driven Clock, its time stands still until it is moved by Advance,
+//sleepers and timers are woken up once the clock reaches their deadlines.
+//It is a MonotonicClock as well, the wall clock steps can be simulated by Step.
+type FakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	mono   time.Duration
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock    *FakeClock
+	c        chan time.Time
+	deadline time.Duration
+}
+
+//NewFakeClock is the constructor for a fake clock starting at the given time
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (f *FakeClock) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+//Sleep blocks the caller routine until the clock is advanced by d
+func (f *FakeClock) Sleep(d time.Duration) {
+	<-f.NewTimer(d).C()
+}
+
+func (f *FakeClock) NewTimer(d time.Duration) Timer {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t := &fakeTimer{
+		clock:    f,
+		c:        make(chan time.Time, 1),
+		deadline: f.mono + d,
+	}
+	if d <= 0 {
+		t.c <- f.now
+	} else {
+		f.timers = append(f.timers, t)
+	}
+	return t
+}
+
+func (f *FakeClock) Monotonic() time.Duration {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.mono
+}
+
+//Step moves the wall clock by d in either direction, like an NTP step,
+//while the monotonic time and the timers are not affected
+func (f *FakeClock) Step(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = f.now.Add(d)
+}
+
+//Advance moves the clock forward by d and fires all the timers whose deadlines are reached
+func (f *FakeClock) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = f.now.Add(d)
+	f.mono += d
+	pending := f.timers[:0]
+	for _, t := range f.timers {
+		if t.deadline > f.mono {
+			pending = append(pending, t)
+		} else {
+			t.c <- f.now
+		}
+	}
+	for i := len(pending); i < len(f.timers); i++ {
+		f.timers[i] = nil
+	}
+	f.timers = pending
+}
+
+//Waiters returns the number of sleepers and timers that have not fired yet
+func (f *FakeClock) Waiters() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.timers)
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	f := t.clock
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, pending := range f.timers {
+		if pending == t {
+			f.timers = append(f.timers[:i], f.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
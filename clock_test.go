@@ -0,0 +1,136 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+//the timers of a fake clock are fired only when the clock is advanced to their deadlines
+func TestFakeClockTimer(t *testing.T) {
+	start := time.Unix(1661990400, 0)
+	clock := NewFakeClock(start)
+
+	timer := clock.NewTimer(10 * time.Millisecond)
+	stopped := clock.NewTimer(10 * time.Millisecond)
+	if !stopped.Stop() || stopped.Stop() {
+		t.Errorf("Stop returns unexpectedly")
+	}
+	if clock.Waiters() != 1 {
+		t.Errorf("Expected 1 waiter, got %d", clock.Waiters())
+	}
+
+	clock.Advance(9 * time.Millisecond)
+	select {
+	case <-timer.C():
+		t.Fatalf("Timer fired before its deadline")
+	default:
+	}
+	clock.Advance(time.Millisecond)
+	select {
+	case now := <-timer.C():
+		if !now.Equal(start.Add(10 * time.Millisecond)) {
+			t.Errorf("Unexpected fire time: %v", now)
+		}
+	default:
+		t.Fatalf("Timer did not fire at its deadline")
+	}
+	if timer.Stop() {
+		t.Errorf("Stop returns true for a fired timer")
+	}
+	select {
+	case <-stopped.C():
+		t.Errorf("Stopped timer fired")
+	default:
+	}
+}
+
+//a sleeper on a fake clock is woken up once the clock is advanced by the sleeping time
+func TestFakeClockSleep(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1661990400, 0))
+	done := make(chan struct{})
+	go func() {
+		clock.Sleep(time.Second)
+		close(done)
+	}()
+	for clock.Waiters() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	clock.Advance(time.Second)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Errorf("Sleeper is not woken up")
+	}
+}
+
+//wallClock hides the monotonic time of a fake clock, like a clock which only has wall clock readings
+type wallClock struct {
+	fake *FakeClock
+}
+
+func (c wallClock) Now() time.Time {
+	return c.fake.Now()
+}
+
+func (c wallClock) Sleep(d time.Duration) {
+	c.fake.Sleep(d)
+}
+
+func (c wallClock) NewTimer(d time.Duration) Timer {
+	return c.fake.NewTimer(d)
+}
+
+//a step of the wall clock moves the readings of Now() but affects neither the monotonic time nor the timers
+func TestFakeClockStep(t *testing.T) {
+	start := time.Unix(1661990400, 0)
+	clock := NewFakeClock(start)
+	timer := clock.NewTimer(time.Second)
+	clock.Step(-time.Hour)
+	clock.Advance(time.Second)
+	if !clock.Now().Equal(start.Add(time.Second-time.Hour)) || clock.Monotonic() != time.Second {
+		t.Errorf("Unexpected readings: %v, %v", clock.Now(), clock.Monotonic())
+	}
+	select {
+	case <-timer.C():
+	default:
+		t.Errorf("Timer did not fire at its deadline")
+	}
+}
+
+//rate limit to 100 req/s, burst is 10, nodelay to false
+//the wall clock is stepped in both directions, it is expected that neither the bucket fills up nor drains by the steps,
+//without a monotonic clock, the elapsed time stands still when the clock is stepped back,
+//but a forward step can not be told from the elapsed time.
+func TestClockSteps(t *testing.T) {
+	fake := NewFakeClock(time.Unix(1661990400, 0))
+	for _, clock := range []Clock{fake, wallClock{fake}} {
+		_, monotonic := clock.(MonotonicClock)
+		rl := NewRateLimiter(100, WithClock(clock)).SetBurst(10)
+		rl.Get()
+		rl.GetDelayInMicrosecondsN(5)
+
+		steps := []struct {
+			step      time.Duration
+			advance   time.Duration
+			delay     time.Duration
+			wallDelay time.Duration
+		}{
+			{-time.Hour, 0, 60 * time.Millisecond, 60 * time.Millisecond},
+			{0, 20 * time.Millisecond, 50 * time.Millisecond, 50 * time.Millisecond},
+			{-time.Minute, 10 * time.Millisecond, 50 * time.Millisecond, 60 * time.Millisecond},
+			{0, 10 * time.Millisecond, 50 * time.Millisecond, 60 * time.Millisecond},
+			{time.Hour, 0, 60 * time.Millisecond, 0},
+		}
+		for i, s := range steps {
+			fake.Step(s.step)
+			fake.Advance(s.advance)
+			delay := s.delay
+			if !monotonic {
+				delay = s.wallDelay
+			}
+			if r := rl.Reserve(); !r.OK() || r.Delay() != delay {
+				t.Errorf("Step %d: unexpected reservation of %T: %v, %v", i, clock, r.OK(), r.Delay())
+			}
+		}
+	}
+}
@@ -0,0 +1,411 @@
+package ratelimit
+
+/*
+Copyright (c) Yunpeng Deng(dypflying)
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+//compositeLimiter enforces all the limits of the child limiters at once
+type compositeLimiter struct {
+	children []Limiter
+	clock    Clock
+}
+
+//NewCompositeLimiter is the contructor for a composite rate limiter, which accepts the requests only if all the child
+//limiters accept them, and delays them by the largest delay time of the children. If any child rejects the requests,
+//the water already poured into the other children is given back, so no capacity leaks when a later check fails.
+//The option of the clock is used for the Get() methods to sleep.
+func NewCompositeLimiter(limiters []Limiter, opts ...Option) Limiter {
+	o := newLimiterOptions(opts)
+	return &compositeLimiter{children: limiters, clock: o.clock}
+}
+
+//reserveAll takes the reservations of the children one by one, and cancels them all once any of them is rejected
+func reserveAll(n int, reserve func(i int) *Reservation) *Reservation {
+	composite := &Reservation{ok: true, children: make([]*Reservation, 0, n)}
+	for i := 0; i < n; i++ {
+		r := reserve(i)
+		if !r.OK() {
+			composite.Cancel()
+			return &Reservation{err: r.err}
+		}
+		composite.join(r)
+	}
+	return composite
+}
+
+func (c *compositeLimiter) ReserveN(n uint32) *Reservation {
+	return reserveAll(len(c.children), func(i int) *Reservation {
+		return c.children[i].ReserveN(n)
+	})
+}
+
+func (c *compositeLimiter) Reserve() *Reservation {
+	return c.ReserveN(1)
+}
+
+func (c *compositeLimiter) GetDelayInMicroseconds() (int64, error) {
+	return c.GetDelayInMicrosecondsN(1)
+}
+
+func (c *compositeLimiter) GetDelayInMicrosecondsN(n uint32) (int64, error) {
+	r := c.ReserveN(n)
+	if !r.ok {
+		return 0, r.err
+	}
+	return r.delay, nil
+}
+
+func (c *compositeLimiter) Get() error {
+	return c.GetN(1)
+}
+
+func (c *compositeLimiter) GetN(n uint32) error {
+	delay, err := c.GetDelayInMicrosecondsN(n)
+	if err != nil {
+		return err
+	} else if delay > 0 {
+		c.clock.Sleep(time.Duration(delay) * time.Microsecond)
+	}
+	return nil
+}
+
+func (c *compositeLimiter) GetContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return waitReservation(ctx, c.clock, c.Reserve())
+}
+
+//SetRate sets the rate of all the children
+func (c *compositeLimiter) SetRate(rate uint32) Limiter {
+	for _, child := range c.children {
+		child.SetRate(rate)
+	}
+	return c
+}
+
+//SetRatePer sets the rate per period of all the children
+func (c *compositeLimiter) SetRatePer(rate Rate) Limiter {
+	for _, child := range c.children {
+		child.SetRatePer(rate)
+	}
+	return c
+}
+
+//SetBurst sets the burst of all the children
+func (c *compositeLimiter) SetBurst(burst uint32) Limiter {
+	for _, child := range c.children {
+		child.SetBurst(burst)
+	}
+	return c
+}
+
+//SetNodelay sets the nodelay option of all the children
+func (c *compositeLimiter) SetNodelay(nodelay bool) Limiter {
+	for _, child := range c.children {
+		child.SetNodelay(nodelay)
+	}
+	return c
+}
+
+//SetDelay sets the delay option of all the children
+func (c *compositeLimiter) SetDelay(delay uint32) Limiter {
+	for _, child := range c.children {
+		child.SetDelay(delay)
+	}
+	return c
+}
+
+//SetResolution sets the resolution of all the children
+func (c *compositeLimiter) SetResolution(resolution Resolution) Limiter {
+	for _, child := range c.children {
+		child.SetResolution(resolution)
+	}
+	return c
+}
+
+//compositeZoneLimiter enforces all the limits of the child zone limiters at once
+type compositeZoneLimiter struct {
+	children []ZoneLimiter
+	clock    Clock
+}
+
+//NewCompositeZoneLimiter is the contructor for a composite zone rate limiter, which has the same semantics
+//as the composite rate limiter for each key. A Limiter can be one of the children by GlobalZone(),
+//e.g. a global limit along with the limits of each tenant.
+func NewCompositeZoneLimiter(limiters []ZoneLimiter, opts ...Option) ZoneLimiter {
+	o := newLimiterOptions(opts)
+	return &compositeZoneLimiter{children: limiters, clock: o.clock}
+}
+
+func (c *compositeZoneLimiter) ReserveN(key interface{}, n uint32) *Reservation {
+	return reserveAll(len(c.children), func(i int) *Reservation {
+		return c.children[i].ReserveN(key, n)
+	})
+}
+
+func (c *compositeZoneLimiter) Reserve(key interface{}) *Reservation {
+	return c.ReserveN(key, 1)
+}
+
+func (c *compositeZoneLimiter) GetDelayInMicroseconds(key interface{}) (int64, error) {
+	return c.GetDelayInMicrosecondsN(key, 1)
+}
+
+func (c *compositeZoneLimiter) GetDelayInMicrosecondsN(key interface{}, n uint32) (int64, error) {
+	r := c.ReserveN(key, n)
+	if !r.ok {
+		return 0, r.err
+	}
+	return r.delay, nil
+}
+
+func (c *compositeZoneLimiter) Get(key interface{}) error {
+	return c.GetN(key, 1)
+}
+
+func (c *compositeZoneLimiter) GetN(key interface{}, n uint32) error {
+	delay, err := c.GetDelayInMicrosecondsN(key, n)
+	if err != nil {
+		return err
+	} else if delay > 0 {
+		c.clock.Sleep(time.Duration(delay) * time.Microsecond)
+	}
+	return nil
+}
+
+func (c *compositeZoneLimiter) GetContext(ctx context.Context, key interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return waitReservation(ctx, c.clock, c.Reserve(key))
+}
+
+//each applies the setter to all the children
+func (c *compositeZoneLimiter) each(set func(child ZoneLimiter)) ZoneLimiter {
+	for _, child := range c.children {
+		set(child)
+	}
+	return c
+}
+
+//eachErr applies the update to all the children, and joins their errors
+func (c *compositeZoneLimiter) eachErr(update func(child ZoneLimiter) error) error {
+	var errs []error
+	for _, child := range c.children {
+		if err := update(child); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (c *compositeZoneLimiter) SetRate(rate uint32) ZoneLimiter {
+	return c.each(func(child ZoneLimiter) { child.SetRate(rate) })
+}
+
+func (c *compositeZoneLimiter) SetRatePer(rate Rate) ZoneLimiter {
+	return c.each(func(child ZoneLimiter) { child.SetRatePer(rate) })
+}
+
+func (c *compositeZoneLimiter) SetBurst(burst uint32) ZoneLimiter {
+	return c.each(func(child ZoneLimiter) { child.SetBurst(burst) })
+}
+
+func (c *compositeZoneLimiter) SetNodelay(nodelay bool) ZoneLimiter {
+	return c.each(func(child ZoneLimiter) { child.SetNodelay(nodelay) })
+}
+
+func (c *compositeZoneLimiter) SetDelay(delay uint32) ZoneLimiter {
+	return c.each(func(child ZoneLimiter) { child.SetDelay(delay) })
+}
+
+func (c *compositeZoneLimiter) SetResolution(resolution Resolution) ZoneLimiter {
+	return c.each(func(child ZoneLimiter) { child.SetResolution(resolution) })
+}
+
+func (c *compositeZoneLimiter) SetUnknownKeyPolicy(policy UnknownKeyPolicy) ZoneLimiter {
+	return c.each(func(child ZoneLimiter) { child.SetUnknownKeyPolicy(policy) })
+}
+
+func (c *compositeZoneLimiter) SetIdleTTL(ttl time.Duration) ZoneLimiter {
+	return c.each(func(child ZoneLimiter) { child.SetIdleTTL(ttl) })
+}
+
+func (c *compositeZoneLimiter) SetMaxEntries(max int) ZoneLimiter {
+	return c.each(func(child ZoneLimiter) { child.SetMaxEntries(max) })
+}
+
+func (c *compositeZoneLimiter) SetOverflowPolicy(policy OverflowPolicy) ZoneLimiter {
+	return c.each(func(child ZoneLimiter) { child.SetOverflowPolicy(policy) })
+}
+
+//Len returns the largest number of the keys held by the children
+func (c *compositeZoneLimiter) Len() int {
+	max := 0
+	for _, child := range c.children {
+		if n := child.Len(); n > max {
+			max = n
+		}
+	}
+	return max
+}
+
+func (c *compositeZoneLimiter) AddZoneItem(key interface{}) error {
+	return c.eachErr(func(child ZoneLimiter) error { return child.AddZoneItem(key) })
+}
+
+func (c *compositeZoneLimiter) DeleteZoneItem(key interface{}) error {
+	return c.eachErr(func(child ZoneLimiter) error { return child.DeleteZoneItem(key) })
+}
+
+//SetZoneItem customizes the key of all the children with the same settings
+func (c *compositeZoneLimiter) SetZoneItem(key interface{}, rate uint32, burst uint32, nodelay bool, opts ...ItemOption) {
+	c.each(func(child ZoneLimiter) { child.SetZoneItem(key, rate, burst, nodelay, opts...) })
+}
+
+func (c *compositeZoneLimiter) StartJanitor(interval time.Duration) {
+	c.each(func(child ZoneLimiter) { child.StartJanitor(interval) })
+}
+
+func (c *compositeZoneLimiter) StopJanitor() {
+	c.each(func(child ZoneLimiter) { child.StopJanitor() })
+}
+
+func (c *compositeZoneLimiter) Close() error {
+	return c.eachErr(func(child ZoneLimiter) error { return child.Close() })
+}
+
+//globalZone adapts a Limiter to a ZoneLimiter which ignores the keys, all the keys share the limiter
+type globalZone struct {
+	Limiter
+}
+
+//GlobalZone returns a ZoneLimiter which takes the limiter for all the keys, it holds no key of its own,
+//so the zone methods on the keys do nothing.
+func GlobalZone(limiter Limiter) ZoneLimiter {
+	return &globalZone{limiter}
+}
+
+func (g *globalZone) GetDelayInMicroseconds(key interface{}) (int64, error) {
+	return g.Limiter.GetDelayInMicroseconds()
+}
+
+func (g *globalZone) GetDelayInMicrosecondsN(key interface{}, n uint32) (int64, error) {
+	return g.Limiter.GetDelayInMicrosecondsN(n)
+}
+
+func (g *globalZone) Get(key interface{}) error {
+	return g.Limiter.Get()
+}
+
+func (g *globalZone) GetN(key interface{}, n uint32) error {
+	return g.Limiter.GetN(n)
+}
+
+func (g *globalZone) Reserve(key interface{}) *Reservation {
+	return g.Limiter.Reserve()
+}
+
+func (g *globalZone) ReserveN(key interface{}, n uint32) *Reservation {
+	return g.Limiter.ReserveN(n)
+}
+
+func (g *globalZone) GetContext(ctx context.Context, key interface{}) error {
+	return g.Limiter.GetContext(ctx)
+}
+
+func (g *globalZone) SetRate(rate uint32) ZoneLimiter {
+	g.Limiter.SetRate(rate)
+	return g
+}
+
+func (g *globalZone) SetRatePer(rate Rate) ZoneLimiter {
+	g.Limiter.SetRatePer(rate)
+	return g
+}
+
+func (g *globalZone) SetBurst(burst uint32) ZoneLimiter {
+	g.Limiter.SetBurst(burst)
+	return g
+}
+
+func (g *globalZone) SetNodelay(nodelay bool) ZoneLimiter {
+	g.Limiter.SetNodelay(nodelay)
+	return g
+}
+
+func (g *globalZone) SetDelay(delay uint32) ZoneLimiter {
+	g.Limiter.SetDelay(delay)
+	return g
+}
+
+func (g *globalZone) SetResolution(resolution Resolution) ZoneLimiter {
+	g.Limiter.SetResolution(resolution)
+	return g
+}
+
+func (g *globalZone) SetUnknownKeyPolicy(policy UnknownKeyPolicy) ZoneLimiter {
+	return g
+}
+
+func (g *globalZone) SetIdleTTL(ttl time.Duration) ZoneLimiter {
+	return g
+}
+
+func (g *globalZone) SetMaxEntries(max int) ZoneLimiter {
+	return g
+}
+
+func (g *globalZone) SetOverflowPolicy(policy OverflowPolicy) ZoneLimiter {
+	return g
+}
+
+func (g *globalZone) Len() int {
+	return 0
+}
+
+func (g *globalZone) AddZoneItem(key interface{}) error {
+	return nil
+}
+
+func (g *globalZone) DeleteZoneItem(key interface{}) error {
+	return nil
+}
+
+func (g *globalZone) SetZoneItem(key interface{}, rate uint32, burst uint32, nodelay bool, opts ...ItemOption) {
+}
+
+func (g *globalZone) StartJanitor(interval time.Duration) {
+}
+
+func (g *globalZone) StopJanitor() {
+}
+
+func (g *globalZone) Close() error {
+	return nil
+}
@@ -0,0 +1,145 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+//two token buckets of 10 req/s, nodelay, burst 5 and 2, driven by a fake clock
+//the composite is expected to be rejected by the smaller one, and the token taken from the larger one is given back
+func TestCompositeRollback(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1661990400, 0))
+	large := NewTokenBucketLimiter(10, WithClock(clock)).SetBurst(5).SetNodelay(true)
+	small := NewTokenBucketLimiter(10, WithClock(clock)).SetBurst(2).SetNodelay(true)
+	rl := NewCompositeLimiter([]Limiter{large, small}, WithClock(clock))
+
+	for i := 0; i < 2; i++ {
+		if _, err := rl.GetDelayInMicroseconds(); err != nil {
+			t.Fatalf("Request %d is rejected unexpectedly: %v", i, err)
+		}
+	}
+	var rejected *RejectedError
+	if _, err := rl.GetDelayInMicroseconds(); !errors.As(err, &rejected) || rejected.RetryAfter != 100*time.Millisecond {
+		t.Fatalf("Expected rejection with a retry after 100ms, got: %v", err)
+	}
+	//the large bucket is expected to hold the 3 tokens not taken by the accepted requests
+	if err := large.GetN(3); err != nil {
+		t.Errorf("Expected the tokens to be given back, got: %v", err)
+	}
+	if _, err := large.GetDelayInMicroseconds(); !errors.Is(err, ErrRejected) {
+		t.Errorf("Expected rejection, got: %v", err)
+	}
+
+	//cancelling a composite reservation gives the tokens back to all the children
+	clock.Advance(time.Second)
+	r := rl.Reserve()
+	if !r.OK() {
+		t.Fatalf("Unexpected rejection")
+	}
+	r.Cancel()
+	r.Cancel()
+	if err := small.GetN(2); err != nil {
+		t.Errorf("Expected the token of the small bucket to be given back, got: %v", err)
+	}
+	if err := large.GetN(5); err != nil {
+		t.Errorf("Expected the token of the large bucket to be given back, got: %v", err)
+	}
+}
+
+//two token buckets of burst 5 at 10 and 20 req/s, driven by a fake clock
+//the composite is expected to delay the reqs by the largest delay of the children
+func TestCompositeDelay(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1661990400, 0))
+	rl := NewCompositeLimiter([]Limiter{
+		NewTokenBucketLimiter(20, WithClock(clock)),
+		NewTokenBucketLimiter(10, WithClock(clock)),
+	}, WithClock(clock)).SetBurst(5)
+
+	for i := 0; i < 10; i++ {
+		delay, err := rl.GetDelayInMicroseconds()
+		if err != nil {
+			t.Fatalf("Request %d is rejected unexpectedly: %v", i, err)
+		}
+		if expected := int64(i-4) * 100000; (i < 5 && delay != 0) || (i >= 5 && delay != expected) {
+			t.Errorf("Unexpected delay of request %d: %d", i, delay)
+		}
+	}
+	if _, err := rl.GetDelayInMicroseconds(); !errors.Is(err, ErrRejected) {
+		t.Errorf("Expected rejection, got: %v", err)
+	}
+}
+
+//a global limit of 3 reqs along with a limit of 2 reqs for each tenant, nodelay, driven by a fake clock
+//a tenant is expected to be limited by its own limit, and all the tenants by the global limit
+func TestCompositeZone(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1661990400, 0))
+	global := NewTokenBucketLimiter(10, WithClock(clock)).SetBurst(3).SetNodelay(true)
+	tenants := NewTokenBucketZoneLimiter(10, WithClock(clock)).SetBurst(2).SetNodelay(true).
+		SetUnknownKeyPolicy(UnknownKeyPolicyEnum.Create)
+	zl := NewCompositeZoneLimiter([]ZoneLimiter{GlobalZone(global), tenants}, WithClock(clock))
+
+	for i := 0; i < 2; i++ {
+		if err := zl.Get("a"); err != nil {
+			t.Fatalf("Request %d of tenant a is rejected unexpectedly: %v", i, err)
+		}
+	}
+	if err := zl.Get("a"); !errors.Is(err, ErrRejected) {
+		t.Errorf("Expected rejection by the tenant limit, got: %v", err)
+	}
+	if err := zl.Get("b"); err != nil {
+		t.Errorf("Unexpected rejection of tenant b: %v", err)
+	}
+	if err := zl.Get("b"); !errors.Is(err, ErrRejected) {
+		t.Errorf("Expected rejection by the global limit, got: %v", err)
+	}
+	//the token of tenant b is given back when the global limit rejects
+	if _, err := tenants.GetDelayInMicroseconds("b"); err != nil {
+		t.Errorf("Expected the token of tenant b to be given back, got: %v", err)
+	}
+	if zl.Len() != 2 {
+		t.Errorf("Unexpected number of keys: %d", zl.Len())
+	}
+	if err := zl.Close(); err != nil {
+		t.Errorf("Unexpected error on close: %v", err)
+	}
+}
+
+//expectDeadlineRejection expects the request to be rejected at once, since its delay runs past the deadline of the context,
+//the rejection is expected to tell the water level and the burst of the bucket delaying the request
+func expectDeadlineRejection(t *testing.T, burst uint32, get func(ctx context.Context) error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	var rejected *RejectedError
+	if err := get(ctx); !errors.As(err, &rejected) || rejected.RetryAfter <= 0 {
+		t.Errorf("Expected rejection with a retry time, got: %v", err)
+	} else if rejected.Burst != burst || rejected.Excess <= 0 {
+		t.Errorf("Expected rejection with the burst of %d and the water level, got: %+v", burst, rejected)
+	}
+}
+
+//a composite of 10 and 100 req/s, burst is 10, the second request is delayed by 100 milliseconds
+//it is expected to be rejected by GetContext() since it can not be served before the deadline
+func TestCompositeGetContext(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1661990400, 0))
+	rl := NewCompositeLimiter([]Limiter{
+		NewRateLimiter(10, WithClock(clock)),
+		NewRateLimiter(100, WithClock(clock)),
+	}, WithClock(clock)).SetBurst(10)
+	if err := rl.GetContext(context.Background()); err != nil {
+		t.Fatalf("First request failed unexpectedly: %v", err)
+	}
+	expectDeadlineRejection(t, 10, rl.GetContext)
+
+	zl := NewCompositeZoneLimiter([]ZoneLimiter{
+		NewZoneRateLimiter(10, WithClock(clock)),
+		NewZoneRateLimiter(100, WithClock(clock)),
+	}, WithClock(clock)).SetBurst(10).SetUnknownKeyPolicy(UnknownKeyPolicyEnum.Create)
+	if err := zl.GetContext(context.Background(), defaultKey); err != nil {
+		t.Fatalf("First request failed unexpectedly: %v", err)
+	}
+	expectDeadlineRejection(t, 10, func(ctx context.Context) error {
+		return zl.GetContext(ctx, defaultKey)
+	})
+}
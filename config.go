@@ -0,0 +1,524 @@
+package ratelimit
+
+/*
+Copyright (c) Yunpeng Deng(dypflying)
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+//ErrInvalidConfig is the error of the configurations failing the validation, each of the errors tells the path of the field
+var ErrInvalidConfig = errors.New("invalid config")
+
+//Config describes the named rate limiters and zone rate limiters, it is decoded from JSON or YAML, e.g.
+//
+//	limiters:
+//	  login: {rate: 30, period: 1m, burst: 5}
+//	zones:
+//	  api:
+//	    rate: 100
+//	    burst: 10
+//	    unknown_key_policy: create
+//	    keys:
+//	      test.com: {rate: 1000, burst: 100}
+type Config struct {
+	Limiters map[string]LimiterConfig `json:"limiters,omitempty" yaml:"limiters,omitempty"`
+	Zones    map[string]ZoneConfig    `json:"zones,omitempty" yaml:"zones,omitempty"`
+}
+
+//LimiterConfig describes a rate limiter
+type LimiterConfig struct {
+	//leaky_bucket (the default), token_bucket, gcra, sliding_window, sliding_log or quota
+	Algorithm string `json:"algorithm,omitempty" yaml:"algorithm,omitempty"`
+	//the count of requests in the period, required, zero value indicates denying all requests
+	Rate *uint32 `json:"rate,omitempty" yaml:"rate,omitempty"`
+	//the period of the rate in the format of time.ParseDuration, default is 1s, it is the window of the sliding windows,
+	//and one of minute, hour, day, week and month for the quota
+	Period string `json:"period,omitempty" yaml:"period,omitempty"`
+	//burst, nodelay and delay are not allowed for the window algorithms and the quota
+	Burst   uint32 `json:"burst,omitempty" yaml:"burst,omitempty"`
+	Nodelay bool   `json:"nodelay,omitempty" yaml:"nodelay,omitempty"`
+	Delay   uint32 `json:"delay,omitempty" yaml:"delay,omitempty"`
+	//millisecond (the default), microsecond_x100, microsecond_x10 or microsecond
+	Resolution string `json:"resolution,omitempty" yaml:"resolution,omitempty"`
+}
+
+//ZoneConfig describes a zone rate limiter, the settings of the limiter are the defaults of the keys
+type ZoneConfig struct {
+	LimiterConfig `yaml:",inline"`
+	//allow (the default), deny or create
+	UnknownKeyPolicy string `json:"unknown_key_policy,omitempty" yaml:"unknown_key_policy,omitempty"`
+	//evict_lru (the default), reject or shared
+	OverflowPolicy string `json:"overflow_policy,omitempty" yaml:"overflow_policy,omitempty"`
+	MaxEntries     int    `json:"max_entries,omitempty" yaml:"max_entries,omitempty"`
+	IdleTTL        string `json:"idle_ttl,omitempty" yaml:"idle_ttl,omitempty"`
+	//the interval of the janitor evicting the idle keys, which is started along with the zone, it requires the idle_ttl
+	JanitorInterval string `json:"janitor_interval,omitempty" yaml:"janitor_interval,omitempty"`
+	Shards          int    `json:"shards,omitempty" yaml:"shards,omitempty"`
+	FairShare       bool   `json:"fair_share,omitempty" yaml:"fair_share,omitempty"`
+	//the customized keys, which are added to the zone
+	Keys map[string]KeyConfig `json:"keys,omitempty" yaml:"keys,omitempty"`
+}
+
+//KeyConfig describes a customized key of a zone, the settings not set are taken from the zone
+type KeyConfig struct {
+	Rate *uint32 `json:"rate,omitempty" yaml:"rate,omitempty"`
+	//the period of the rate, it is not allowed for the quota
+	Period  string  `json:"period,omitempty" yaml:"period,omitempty"`
+	Burst   *uint32 `json:"burst,omitempty" yaml:"burst,omitempty"`
+	Nodelay *bool   `json:"nodelay,omitempty" yaml:"nodelay,omitempty"`
+	Delay   *uint32 `json:"delay,omitempty" yaml:"delay,omitempty"`
+	//the weight of the key in the fair share mode, it requires the fair_share of the zone
+	Weight uint32 `json:"weight,omitempty" yaml:"weight,omitempty"`
+}
+
+//Registry holds the rate limiters and the zone rate limiters built from a Config by their names
+type Registry struct {
+	Limiters map[string]Limiter
+	Zones    map[string]ZoneLimiter
+}
+
+//Close stops the janitors of the zone rate limiters, the rate limiters are still usable afterwards
+func (r *Registry) Close() error {
+	for _, zone := range r.Zones {
+		zone.Close()
+	}
+	return nil
+}
+
+var (
+	configAlgorithms = map[string]Algorithm{
+		"":               AlgorithmEnum.LeakyBucket,
+		"leaky_bucket":   AlgorithmEnum.LeakyBucket,
+		"token_bucket":   AlgorithmEnum.TokenBucket,
+		"gcra":           AlgorithmEnum.GCRA,
+		"sliding_window": AlgorithmEnum.SlidingWindow,
+		"sliding_log":    AlgorithmEnum.SlidingLog,
+		"quota":          AlgorithmEnum.Quota,
+	}
+	configQuotaPeriods = map[string]QuotaPeriod{
+		"minute": QuotaPeriodEnum.Minute,
+		"hour":   QuotaPeriodEnum.Hour,
+		"day":    QuotaPeriodEnum.Day,
+		"week":   QuotaPeriodEnum.Week,
+		"month":  QuotaPeriodEnum.Month,
+	}
+	configResolutions = map[string]Resolution{
+		"":                 ResolutionEnum.Millisecond,
+		"millisecond":      ResolutionEnum.Millisecond,
+		"microsecond_x100": ResolutionEnum.MicrosecondX100,
+		"microsecond_x10":  ResolutionEnum.MicrosecondX10,
+		"microsecond":      ResolutionEnum.Microsecond,
+	}
+	configUnknownKeyPolicies = map[string]UnknownKeyPolicy{
+		"":       UnknownKeyPolicyEnum.Allow,
+		"allow":  UnknownKeyPolicyEnum.Allow,
+		"deny":   UnknownKeyPolicyEnum.Deny,
+		"create": UnknownKeyPolicyEnum.Create,
+	}
+	configOverflowPolicies = map[string]OverflowPolicy{
+		"":          OverflowPolicyEnum.EvictLRU,
+		"evict_lru": OverflowPolicyEnum.EvictLRU,
+		"reject":    OverflowPolicyEnum.Reject,
+		"shared":    OverflowPolicyEnum.Shared,
+	}
+)
+
+//limiterSpec is the validated settings of a rate limiter
+type limiterSpec struct {
+	algorithm  Algorithm
+	rate       Rate
+	quota      QuotaPeriod
+	burst      uint32
+	nodelay    bool
+	delay      uint32
+	resolution Resolution
+}
+
+//zoneSpec is the validated settings of a zone rate limiter
+type zoneSpec struct {
+	limiterSpec
+	unknownKeyPolicy UnknownKeyPolicy
+	overflowPolicy   OverflowPolicy
+	maxEntries       int
+	idleTTL          time.Duration
+	janitorInterval  time.Duration
+	shards           int
+	fair             bool
+	keys             map[string]keySpec
+}
+
+//keySpec is the validated settings of a customized key, which is comparable
+type keySpec struct {
+	rate    Rate
+	burst   uint32
+	nodelay bool
+	delay   uint32
+	weight  uint32
+}
+
+//configErrors collects the validation errors along with the paths of the fields
+type configErrors []error
+
+func (e *configErrors) add(path string, format string, a ...interface{}) {
+	*e = append(*e, fmt.Errorf("%w: %s: %s", ErrInvalidConfig, path, fmt.Sprintf(format, a...)))
+}
+
+//sortedNames returns the names of the map in order, so the errors are reported in a stable order
+func sortedNames[V any](m map[string]V) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+//lookup returns the value of the name in the map, the empty name is the default if it is in the map
+func lookup[V any](errs *configErrors, path string, m map[string]V, name string) V {
+	v, ok := m[name]
+	if !ok {
+		names := sortedNames(m)
+		if names[0] == "" {
+			names = names[1:]
+		}
+		errs.add(path, "unknown value %q, expecting one of %q", name, names)
+	}
+	return v
+}
+
+func parseDuration(errs *configErrors, path string, value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		errs.add(path, "invalid duration %q", value)
+	}
+	return d
+}
+
+//parsePeriod parses the period of the rate, a calendar period for the quota
+func parsePeriod(errs *configErrors, path string, algorithm Algorithm, value string) (time.Duration, QuotaPeriod) {
+	if algorithm == AlgorithmEnum.Quota {
+		if value == "" {
+			errs.add(path, "required for the quota")
+			return 0, 0
+		}
+		return 0, lookup(errs, path, configQuotaPeriods, value)
+	}
+	period := parseDuration(errs, path, value)
+	if value != "" && period == 0 {
+		errs.add(path, "must be positive")
+	}
+	return period, 0
+}
+
+//bucketed tells whether the algorithm has a bucket, which takes the burst, nodelay and delay settings
+func bucketed(algorithm Algorithm) bool {
+	return algorithm == AlgorithmEnum.LeakyBucket || algorithm == AlgorithmEnum.TokenBucket || algorithm == AlgorithmEnum.GCRA
+}
+
+func (c *LimiterConfig) spec(errs *configErrors, path string) limiterSpec {
+	s := limiterSpec{
+		algorithm:  lookup(errs, path+".algorithm", configAlgorithms, c.Algorithm),
+		resolution: lookup(errs, path+".resolution", configResolutions, c.Resolution),
+		burst:      c.Burst,
+		nodelay:    c.Nodelay,
+		delay:      c.Delay,
+	}
+	var period time.Duration
+	period, s.quota = parsePeriod(errs, path+".period", s.algorithm, c.Period)
+	if c.Rate == nil {
+		errs.add(path+".rate", "required")
+	} else {
+		s.rate = Per(*c.Rate, period)
+	}
+	if !bucketed(s.algorithm) {
+		if c.Burst != 0 || c.Nodelay || c.Delay != 0 {
+			errs.add(path, "burst, nodelay and delay are not allowed for %s", c.Algorithm)
+		}
+	} else if c.Nodelay && c.Delay != 0 {
+		errs.add(path+".delay", "not allowed along with nodelay")
+	}
+	return s
+}
+
+func (c *ZoneConfig) spec(errs *configErrors, path string) zoneSpec {
+	s := zoneSpec{
+		limiterSpec:      c.LimiterConfig.spec(errs, path),
+		unknownKeyPolicy: lookup(errs, path+".unknown_key_policy", configUnknownKeyPolicies, c.UnknownKeyPolicy),
+		overflowPolicy:   lookup(errs, path+".overflow_policy", configOverflowPolicies, c.OverflowPolicy),
+		maxEntries:       c.MaxEntries,
+		idleTTL:          parseDuration(errs, path+".idle_ttl", c.IdleTTL),
+		janitorInterval:  parseDuration(errs, path+".janitor_interval", c.JanitorInterval),
+		shards:           c.Shards,
+		fair:             c.FairShare,
+		keys:             make(map[string]keySpec, len(c.Keys)),
+	}
+	if c.MaxEntries < 0 {
+		errs.add(path+".max_entries", "must not be negative")
+	}
+	if c.Shards < 0 {
+		errs.add(path+".shards", "must not be negative")
+	}
+	if s.janitorInterval > 0 && s.idleTTL == 0 {
+		errs.add(path+".janitor_interval", "requires idle_ttl")
+	}
+	for _, name := range sortedNames(c.Keys) {
+		key := c.Keys[name]
+		s.keys[name] = key.spec(errs, fmt.Sprintf("%s.keys[%s]", path, name), &s)
+	}
+	return s
+}
+
+func (c *KeyConfig) spec(errs *configErrors, path string, zone *zoneSpec) keySpec {
+	s := keySpec{
+		rate:    zone.rate,
+		burst:   zone.burst,
+		nodelay: zone.nodelay,
+		delay:   zone.delay,
+		weight:  c.Weight,
+	}
+	if c.Period != "" {
+		if zone.algorithm == AlgorithmEnum.Quota {
+			errs.add(path+".period", "not allowed for the quota")
+		} else {
+			period, _ := parsePeriod(errs, path+".period", zone.algorithm, c.Period)
+			s.rate = Per(s.rate.count, period)
+		}
+	}
+	if c.Rate != nil {
+		s.rate = Per(*c.Rate, s.rate.Period())
+	}
+	if c.Burst != nil {
+		s.burst = *c.Burst
+	}
+	if c.Nodelay != nil {
+		s.nodelay = *c.Nodelay
+	}
+	if c.Delay != nil {
+		s.delay = *c.Delay
+	}
+	if !bucketed(zone.algorithm) {
+		if c.Burst != nil || c.Nodelay != nil || c.Delay != nil {
+			errs.add(path, "burst, nodelay and delay are not allowed for the algorithm of the zone")
+		}
+	} else if (c.Nodelay != nil || c.Delay != nil) && s.nodelay && s.delay != 0 {
+		errs.add(path+".delay", "not allowed along with nodelay")
+	}
+	if c.Weight != 0 && !zone.fair {
+		errs.add(path+".weight", "requires fair_share of the zone")
+	}
+	return s
+}
+
+//specs validates the config, and returns the settings of the limiters and the zones by their names
+func (c *Config) specs() (map[string]limiterSpec, map[string]zoneSpec, error) {
+	var errs configErrors
+	limiters := make(map[string]limiterSpec, len(c.Limiters))
+	for _, name := range sortedNames(c.Limiters) {
+		limiter := c.Limiters[name]
+		if name == "" {
+			errs.add("limiters", "empty name")
+		}
+		limiters[name] = limiter.spec(&errs, fmt.Sprintf("limiters[%s]", name))
+	}
+	zones := make(map[string]zoneSpec, len(c.Zones))
+	for _, name := range sortedNames(c.Zones) {
+		zone := c.Zones[name]
+		if name == "" {
+			errs.add("zones", "empty name")
+		}
+		zones[name] = zone.spec(&errs, fmt.Sprintf("zones[%s]", name))
+	}
+	return limiters, zones, errors.Join(errs...)
+}
+
+//Validate checks the config strictly, all the errors found are returned joined, each of which wraps ErrInvalidConfig
+func (c *Config) Validate() error {
+	_, _, err := c.specs()
+	return err
+}
+
+//Build validates the config and builds the rate limiters and the zone rate limiters, the options apply to all of them,
+//while the algorithm of the config overrides the one of the options
+func (c *Config) Build(opts ...Option) (*Registry, error) {
+	limiters, zones, err := c.specs()
+	if err != nil {
+		return nil, err
+	}
+	registry := &Registry{
+		Limiters: make(map[string]Limiter, len(limiters)),
+		Zones:    make(map[string]ZoneLimiter, len(zones)),
+	}
+	for name, s := range limiters {
+		registry.Limiters[name] = s.newLimiter(opts)
+	}
+	for name, s := range zones {
+		registry.Zones[name] = s.newZoneLimiter(opts)
+	}
+	return registry, nil
+}
+
+func (s *limiterSpec) options(opts []Option) []Option {
+	return append(opts[:len(opts):len(opts)], WithAlgorithm(s.algorithm))
+}
+
+func (s *limiterSpec) newLimiter(opts []Option) Limiter {
+	var l Limiter
+	if s.algorithm == AlgorithmEnum.Quota {
+		l = NewQuotaLimiter(s.rate.count, s.quota, opts...)
+	} else {
+		l = NewRateLimiterPer(s.rate, s.options(opts)...)
+	}
+	s.apply(l)
+	return l
+}
+
+//apply sets the settings to the limiter
+func (s *limiterSpec) apply(l Limiter) {
+	l.SetBurst(s.burst)
+	l.SetNodelay(s.nodelay)
+	l.SetDelay(s.delay)
+	l.SetResolution(s.resolution)
+	if s.algorithm != AlgorithmEnum.Quota {
+		l.SetRatePer(s.rate)
+	} else {
+		l.SetRate(s.rate.count)
+	}
+}
+
+func (s *zoneSpec) newZoneLimiter(opts []Option) ZoneLimiter {
+	opts = s.options(opts)
+	if s.shards > 0 {
+		opts = append(opts, WithShards(s.shards))
+	}
+	if s.fair {
+		opts = append(opts, WithFairShare())
+	}
+	var z ZoneLimiter
+	if s.algorithm == AlgorithmEnum.Quota {
+		z = NewQuotaZoneLimiter(s.rate.count, s.quota, opts...)
+	} else {
+		z = NewZoneRateLimiterPer(s.rate, opts...)
+	}
+	s.apply(z)
+	for key, k := range s.keys {
+		k.apply(z, key)
+	}
+	if s.janitorInterval > 0 {
+		z.StartJanitor(s.janitorInterval)
+	}
+	return z
+}
+
+//apply sets the defaults of the zone, the existing keys are not affected
+func (s *zoneSpec) apply(z ZoneLimiter) {
+	z.SetBurst(s.burst)
+	z.SetNodelay(s.nodelay)
+	z.SetDelay(s.delay)
+	z.SetResolution(s.resolution)
+	z.SetUnknownKeyPolicy(s.unknownKeyPolicy)
+	z.SetOverflowPolicy(s.overflowPolicy)
+	z.SetMaxEntries(s.maxEntries)
+	z.SetIdleTTL(s.idleTTL)
+	if s.algorithm != AlgorithmEnum.Quota {
+		z.SetRatePer(s.rate)
+	} else {
+		z.SetRate(s.rate.count)
+	}
+}
+
+//apply sets the key to the zone, the water level of an existing key is kept
+func (k keySpec) apply(z ZoneLimiter, key string) {
+	z.SetZoneItem(key, k.rate.count, k.burst, k.nodelay, WithRate(k.rate), WithDelay(k.delay), WithWeight(k.weight))
+}
+
+//ParseJSONConfig decodes the config from JSON strictly, the unknown fields and the trailing data are not allowed,
+//and validates it
+func ParseJSONConfig(r io.Reader) (*Config, error) {
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	config := &Config{}
+	if err := decoder.Decode(config); err != nil {
+		return nil, err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, errors.New("invalid character after top-level value")
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+//ParseYAMLConfig decodes the config from YAML strictly, the unknown fields and the duplicate keys are not allowed,
+//and validates it. An empty document is an empty config.
+func ParseYAMLConfig(r io.Reader) (*Config, error) {
+	decoder := yaml.NewDecoder(r)
+	decoder.KnownFields(true)
+	config := &Config{}
+	if err := decoder.Decode(config); err != nil && err != io.EOF {
+		return nil, err
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+//LoadConfigFile parses the config file by its extension, .json for JSON, .yaml and .yml for YAML,
+//and builds the rate limiters and the zone rate limiters
+func LoadConfigFile(path string, opts ...Option) (*Registry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config, err := parseConfigFile(path, data)
+	if err != nil {
+		return nil, err
+	}
+	return config.Build(opts...)
+}
+
+//parseConfigFile parses the content of the config file by the extension of its path
+func parseConfigFile(path string, data []byte) (*Config, error) {
+	switch ext := filepath.Ext(path); ext {
+	case ".json":
+		return ParseJSONConfig(bytes.NewReader(data))
+	case ".yaml", ".yml":
+		return ParseYAMLConfig(bytes.NewReader(data))
+	default:
+		return nil, fmt.Errorf("unknown config format %q", ext)
+	}
+}
@@ -0,0 +1,195 @@
+package ratelimit
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const yamlConfig = `
+limiters:
+  login:
+    rate: 30
+    period: 1m
+    burst: 5
+    nodelay: true
+  daily:
+    algorithm: quota
+    rate: 1000
+    period: day
+zones:
+  api:
+    algorithm: gcra
+    rate: 100
+    burst: 10
+    delay: 5
+    resolution: microsecond
+    unknown_key_policy: create
+    max_entries: 1000
+    idle_ttl: 10m
+    janitor_interval: 1m
+    keys:
+      test.com: {rate: 1000, burst: 100}
+      slow.com: {period: 1m}
+`
+
+const jsonConfig = `{
+  "limiters": {
+    "login": {"rate": 30, "period": "1m", "burst": 5, "nodelay": true},
+    "daily": {"algorithm": "quota", "rate": 1000, "period": "day"}
+  },
+  "zones": {
+    "api": {
+      "algorithm": "gcra", "rate": 100, "burst": 10, "delay": 5, "resolution": "microsecond",
+      "unknown_key_policy": "create", "max_entries": 1000, "idle_ttl": "10m", "janitor_interval": "1m",
+      "keys": {
+        "test.com": {"rate": 1000, "burst": 100},
+        "slow.com": {"period": "1m"}
+      }
+    }
+  }
+}`
+
+//the JSON and the YAML configs of the same settings are validated into the same specs
+func TestParseConfig(t *testing.T) {
+	yamlConf, err := ParseYAMLConfig(strings.NewReader(yamlConfig))
+	if err != nil {
+		t.Fatalf("Unexpected error of YAML: %v", err)
+	}
+	jsonConf, err := ParseJSONConfig(strings.NewReader(jsonConfig))
+	if err != nil {
+		t.Fatalf("Unexpected error of JSON: %v", err)
+	}
+	yamlLimiters, yamlZones, _ := yamlConf.specs()
+	jsonLimiters, jsonZones, _ := jsonConf.specs()
+	if !reflect.DeepEqual(yamlLimiters, jsonLimiters) || !reflect.DeepEqual(yamlZones, jsonZones) {
+		t.Errorf("Expected the same specs, got: %v %v, %v %v", yamlLimiters, yamlZones, jsonLimiters, jsonZones)
+	}
+	api := yamlZones["api"]
+	if api.algorithm != AlgorithmEnum.GCRA || api.resolution != ResolutionEnum.Microsecond || api.idleTTL != 10*time.Minute ||
+		api.unknownKeyPolicy != UnknownKeyPolicyEnum.Create || api.maxEntries != 1000 {
+		t.Errorf("Unexpected settings of the zone: %+v", api)
+	}
+	//the settings not set are taken from the zone
+	if key := api.keys["test.com"]; key != (keySpec{rate: Per(1000, time.Second), burst: 100, delay: 5}) {
+		t.Errorf("Unexpected settings of test.com: %+v", key)
+	}
+	if key := api.keys["slow.com"]; key != (keySpec{rate: Per(100, time.Minute), burst: 10, delay: 5}) {
+		t.Errorf("Unexpected settings of slow.com: %+v", key)
+	}
+}
+
+//the limiters built from a config file are ready to use
+func TestLoadConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "limits.yaml")
+	if err := os.WriteFile(path, []byte(yamlConfig), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	clock := NewFakeClock(time.Unix(1661990400, 0))
+	registry, err := LoadConfigFile(path, WithClock(clock))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer registry.Close()
+	if len(registry.Limiters) != 2 || len(registry.Zones) != 1 {
+		t.Fatalf("Unexpected registry: %v", registry)
+	}
+	//login: 30 req/min, burst 5, nodelay, the first request leaks out at once
+	login := registry.Limiters["login"]
+	for i := 0; i < 6; i++ {
+		if delay, err := login.GetDelayInMicroseconds(); err != nil || delay != 0 {
+			t.Fatalf("Request %d of login: unexpected delay %d, %v", i, delay, err)
+		}
+	}
+	var rejected *RejectedError
+	if err := login.Get(); !errors.As(err, &rejected) || rejected.RetryAfter != 2*time.Second {
+		t.Errorf("Expected the request beyond the burst of login to retry after 2 seconds, got: %v", err)
+	}
+	if remaining, _ := registry.Limiters["daily"].(QuotaLimiter).Remaining(); remaining != 1000 {
+		t.Errorf("Expected the daily quota of 1000, got: %d", remaining)
+	}
+	//api: the customized keys are added, and the unknown keys are created with the defaults
+	api := registry.Zones["api"]
+	if api.Len() != 2 {
+		t.Errorf("Expected the customized keys to be added, got %d keys", api.Len())
+	}
+	api.Get("new.com")
+	if api.Len() != 3 {
+		t.Errorf("Expected the unknown key to be created, got %d keys", api.Len())
+	}
+	//slow.com: 100 req/min, the first 5 excess requests pass without delay
+	for i := 0; i < 6; i++ {
+		api.Get("slow.com")
+	}
+	if delay, err := api.GetDelayInMicroseconds("slow.com"); err != nil || delay != 600000 {
+		t.Errorf("Expected the 6th excess request of slow.com to be delayed by 600ms, got: %d, %v", delay, err)
+	}
+}
+
+//the configs are validated strictly, all the errors are reported with the paths of the fields
+func TestConfigErrors(t *testing.T) {
+	for _, c := range []struct {
+		config   string
+		invalid  bool
+		messages []string
+	}{
+		{"limiters: {a: {burst: 1}}", true, []string{"limiters[a].rate: required"}},
+		{"limiters: {a: {rate: 1, algorithm: foo, resolution: second}}", true, []string{
+			`limiters[a].algorithm: unknown value "foo"`,
+			`limiters[a].resolution: unknown value "second", expecting one of ["microsecond" "microsecond_x10" "microsecond_x100" "millisecond"]`,
+		}},
+		{"limiters: {a: {rate: 1, period: 0s}, b: {rate: 1, period: 1x}}", true, []string{
+			"limiters[a].period: must be positive",
+			`limiters[b].period: invalid duration "1x"`,
+		}},
+		{"limiters: {a: {rate: 1, algorithm: quota}, b: {rate: 1, algorithm: quota, period: 1h}}", true, []string{
+			"limiters[a].period: required for the quota",
+			`limiters[b].period: unknown value "1h", expecting one of ["day" "hour" "minute" "month" "week"]`,
+		}},
+		{"limiters: {a: {rate: 1, algorithm: sliding_log, burst: 1}}", true, []string{
+			"limiters[a]: burst, nodelay and delay are not allowed for sliding_log",
+		}},
+		{"limiters: {a: {rate: 1, nodelay: true, delay: 1}}", true, []string{"limiters[a].delay: not allowed along with nodelay"}},
+		{"zones: {a: {rate: 1, unknown_key_policy: drop, overflow_policy: lru, max_entries: -1, shards: -1}}", true, []string{
+			`zones[a].unknown_key_policy: unknown value "drop", expecting one of ["allow" "create" "deny"]`,
+			`zones[a].overflow_policy: unknown value "lru", expecting one of ["evict_lru" "reject" "shared"]`,
+			"zones[a].max_entries: must not be negative",
+			"zones[a].shards: must not be negative",
+		}},
+		{"zones: {a: {rate: 1, janitor_interval: 1m, idle_ttl: -1m}}", true, []string{
+			`zones[a].idle_ttl: invalid duration "-1m"`,
+		}},
+		{"zones: {a: {rate: 1, janitor_interval: 1m}}", true, []string{"zones[a].janitor_interval: requires idle_ttl"}},
+		{"zones: {a: {rate: 1, burst: 1, delay: 1, keys: {b: {nodelay: true, weight: 2}}}}", true, []string{
+			"zones[a].keys[b].delay: not allowed along with nodelay",
+			"zones[a].keys[b].weight: requires fair_share of the zone",
+		}},
+		{"zones: {a: {rate: 1, algorithm: quota, period: day, keys: {b: {period: 1m, burst: 1}}}}", true, []string{
+			"zones[a].keys[b].period: not allowed for the quota",
+			"zones[a].keys[b]: burst, nodelay and delay are not allowed for the algorithm of the zone",
+		}},
+		{"zones: {a: {rate: 1, burts: 1}}", false, []string{"field burts not found"}},
+		{"zones: {a: {rate: -1}}", false, []string{"cannot unmarshal !!int `-1` into uint32"}},
+		{"zones: {a: {rate: 1}, a: {rate: 2}}", false, []string{`mapping key "a" already defined`}},
+	} {
+		_, err := ParseYAMLConfig(strings.NewReader(c.config))
+		if err == nil || errors.Is(err, ErrInvalidConfig) != c.invalid {
+			t.Errorf("%s: unexpected error: %v", c.config, err)
+			continue
+		}
+		for _, message := range c.messages {
+			if !strings.Contains(err.Error(), message) {
+				t.Errorf("%s: expected the error of %s, got: %v", c.config, message, err)
+			}
+		}
+	}
+	for _, config := range []string{`{"zones": {"a": {"rate": 1, "keys": {"b": {"rates": 1}}}}}`, `{"zones": {}} {}`} {
+		if _, err := ParseJSONConfig(strings.NewReader(config)); err == nil {
+			t.Errorf("%s: expected an error", config)
+		}
+	}
+}
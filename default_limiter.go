@@ -23,110 +23,130 @@ SOFTWARE.
 */
 
 import (
-	"sync/atomic"
+	"context"
 	"time"
 )
 
 type rateLimiter struct {
-	limiterMeta
-	limiterRecord
+	limiterConfig
+	bucket
+	limiterOptions
 }
 
 //NewRateLimiter is the contructor for a rate limiter
-func NewRateLimiter(rate uint32) Limiter {
+func NewRateLimiter(rate uint32, opts ...Option) Limiter {
 
 	r := &rateLimiter{}
-	r.rate = rate
-	r.resolution = ResolutionEnum.Millisecond
-	atomic.StoreInt64(&r.excess, 0)
-	atomic.StoreInt64(&r.last, 0)
+	r.limiterOptions = newLimiterOptions(opts)
+	r.storeMeta(&limiterMeta{
+		rate:       rate,
+		resolution: ResolutionEnum.Millisecond,
+	})
+	r.bucket = r.newBucket(0)
 	return r
 }
 
 func (r *rateLimiter) SetRate(rate uint32) Limiter {
 	if r != nil {
-		r.rate = rate
+		r.updateMeta(func(meta *limiterMeta) {
+			meta.rate = rate
+		})
+	}
+	return r
+}
+
+//SetRatePer sets the rate as a count of requests per period, SetRate() changes the count in the same period afterwards
+func (r *rateLimiter) SetRatePer(rate Rate) Limiter {
+	if r != nil {
+		r.updateMeta(rate.apply)
 	}
 	return r
 }
 
 func (r *rateLimiter) SetBurst(burst uint32) Limiter {
 	if r != nil {
-		r.burst = burst
+		r.updateMeta(func(meta *limiterMeta) {
+			meta.burst = burst
+		})
 	}
 	return r
 }
 
 func (r *rateLimiter) SetNodelay(nodelay bool) Limiter {
 	if r != nil {
-		r.nodelay = nodelay
+		r.updateMeta(func(meta *limiterMeta) {
+			meta.nodelay = nodelay
+		})
+	}
+	return r
+}
+
+//SetDelay sets the number of the excess requests passing without delay, like the delay parameter of nginx,
+//the rest up to the burst are delayed, default is 0. nodelay lets all of them pass as the delay of the burst does.
+func (r *rateLimiter) SetDelay(delay uint32) Limiter {
+	if r != nil {
+		r.updateMeta(func(meta *limiterMeta) {
+			meta.delay = delay
+		})
 	}
 	return r
 }
 
 func (r *rateLimiter) SetResolution(resolution Resolution) Limiter {
 	if r != nil {
-		r.resolution = resolution
+		r.updateMeta(func(meta *limiterMeta) {
+			meta.resolution = resolution
+		})
 	}
 	return r
 }
 
 func (r *rateLimiter) Get() error {
+	return r.GetN(1)
+}
 
-	delay, err := r.GetDelayInMicroseconds()
+func (r *rateLimiter) GetN(n uint32) error {
+
+	delay, err := r.GetDelayInMicrosecondsN(n)
 	if err != nil {
 		return err
 	} else if delay > 0 {
-		time.Sleep(time.Duration(delay) * time.Microsecond)
+		r.clock.Sleep(time.Duration(delay) * time.Microsecond)
 	}
 	return nil
 }
 
+func (r *rateLimiter) GetContext(ctx context.Context) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return waitReservation(ctx, r.clock, r.Reserve())
+}
+
+func (r *rateLimiter) Reserve() *Reservation {
+	return r.ReserveN(1)
+}
+
+func (r *rateLimiter) ReserveN(n uint32) *Reservation {
+	meta := r.loadMeta()
+	return r.reserveN(meta, meta.resolution, &r.limiterOptions, n)
+}
+
 //return:
 //	#1. the delay time in microseconds
 //	#2. error if rejected
 func (r *rateLimiter) GetDelayInMicroseconds() (int64, error) {
-	var (
-		excess, lastExcess int64
-	)
-	if r.rate == 0 {
-		return 0, errorReject
-	}
-	resolutionFactor := 1e9 / r.resolution
-	rate := int64(r.rate) * resolutionFactor
-	burst := int64(r.burst) * resolutionFactor
-
-	for {
-		//note: after golang 1.17, it introduced UnixMilli() and UnixMicro() functions,
-		//but to support the golang before 1.17, we still use UnixNano to retrieve the timestamps.
-		now := time.Now().UnixNano() / r.resolution
-
-		elapsed := now - r.last
-		//Note: the elapsed value may be huge since it is retrieved from the nanoseconds from 1970.1.1 for the first call of the object
-		//here we set a quota for the elapsed with a maximum of 1 hour
-		if elapsed > int64(time.Hour)/r.resolution {
-			elapsed = int64(time.Hour) / r.resolution
-		}
-
-		lastExcess = atomic.LoadInt64(&r.excess)
-		excess = lastExcess - rate/resolutionFactor*elapsed + resolutionFactor
-
-		if excess < 0 {
-			excess = 0
-		}
-
-		if excess > burst {
-			return 0, errorReject
-		}
-		if atomic.CompareAndSwapInt64(&r.excess, lastExcess, excess) {
-			r.last = now
-			break
-		}
-	}
-	if !r.nodelay {
-		delayInSecond := float64(excess) / float64(rate)
-		return int64(delayInSecond * 1e6), nil
-	}
+	return r.GetDelayInMicrosecondsN(1)
+}
 
-	return 0, nil
+//return:
+//	#1. the delay time in microseconds for the whole n requests
+//	#2. error if rejected
+func (r *rateLimiter) GetDelayInMicrosecondsN(n uint32) (int64, error) {
+	reservation := r.ReserveN(n)
+	if !reservation.ok {
+		return 0, reservation.err
+	}
+	return reservation.delay, nil
 }
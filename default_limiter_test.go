@@ -1,7 +1,9 @@
 package ratelimit
 
 import (
+	"context"
 	"errors"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -130,3 +132,381 @@ func TestZeroRate(t *testing.T) {
 		t.Errorf("Error count is not expected")
 	}
 }
+
+//rate limit to 10 req/s, burst is 10, the second request is delayed by 100 milliseconds
+//it is expected that the request is rejected immediately since it can not be served before the deadline
+func TestGetContextDeadline(t *testing.T) {
+	t.Parallel()
+	rl := NewRateLimiter(10).SetBurst(10)
+	if err := rl.GetContext(context.Background()); err != nil {
+		t.Fatalf("First request failed unexpectedly: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := rl.GetContext(ctx); !errors.Is(err, ErrRejected) {
+		t.Errorf("Expected rejection, got: %v", err)
+	}
+	if time.Since(start) > 10*time.Millisecond {
+		t.Errorf("Rejection is not immediate")
+	}
+	if excess := rl.(*rateLimiter).bucket.(*limiterRecord).load().excess; excess != 0 {
+		t.Errorf("The slot is not given back, excess: %d", excess)
+	}
+}
+
+//rate limit to 10 req/s, burst is 10, the second request is delayed by 100 milliseconds
+//it is expected that the request wakes up as soon as the context is canceled and gives back the water not leaked yet
+func TestGetContextCancel(t *testing.T) {
+	t.Parallel()
+	rl := NewRateLimiter(10).SetBurst(10)
+	if err := rl.GetContext(context.Background()); err != nil {
+		t.Fatalf("First request failed unexpectedly: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	start := time.Now()
+	if err := rl.GetContext(ctx); err != context.Canceled {
+		t.Errorf("Expected context canceled, got: %v", err)
+	}
+	if time.Since(start) > 50*time.Millisecond {
+		t.Errorf("Did not wake up on cancellation")
+	}
+	if excess := rl.(*rateLimiter).bucket.(*limiterRecord).load().excess; excess >= int64(time.Second/time.Millisecond) {
+		t.Errorf("The slot is not given back, excess: %d", excess)
+	}
+	if err := rl.GetContext(ctx); err != context.Canceled {
+		t.Errorf("Expected context canceled for a done context, got: %v", err)
+	}
+}
+
+//rate limit to 1000 req/s, burst is 10, nodelay to false, microsecond resolution, driven by a fake clock
+//10,000 reqs are supposed to be finished in exact 10 seconds of the fake clock
+func TestFakeClockRate(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1661990400, 0))
+	start := clock.Now()
+	rl := NewRateLimiter(1000, WithClock(clock)).SetBurst(10).SetResolution(ResolutionEnum.Microsecond)
+	for i := 0; i < 10000; i++ {
+		delay, err := rl.GetDelayInMicroseconds()
+		if err != nil {
+			t.Fatalf("Request %d is rejected unexpectedly: %v", i, err)
+		}
+		clock.Advance(time.Duration(delay) * time.Microsecond)
+	}
+	if elapsed := clock.Now().Sub(start); elapsed != 9999*time.Millisecond {
+		t.Errorf("Finished unexpectedly in %v", elapsed)
+	}
+}
+
+//rate limit to 100 req/s, burst is 10, nodelay to true, driven by a fake clock
+//it is expected that exact 11 reqs pass at the same instant and the following ones pass one per 10 milliseconds
+func TestFakeClockNodelay(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1661990400, 0))
+	rl := NewRateLimiter(100, WithClock(clock)).SetBurst(10).SetNodelay(true)
+	passed := 0
+	for i := 0; i < 100; i++ {
+		if _, err := rl.GetDelayInMicroseconds(); err == nil {
+			passed++
+		}
+	}
+	if passed != 11 {
+		t.Errorf("Expected 11 reqs passed, got %d", passed)
+	}
+	for i := 0; i < 10; i++ {
+		clock.Advance(10 * time.Millisecond)
+		if _, err := rl.GetDelayInMicroseconds(); err != nil {
+			t.Errorf("Request is rejected unexpectedly: %v", err)
+		}
+		if _, err := rl.GetDelayInMicroseconds(); err == nil {
+			t.Errorf("Request passed unexpectedly")
+		}
+	}
+}
+
+//rate limit to 10 req/s, driven by a fake clock
+//it is expected that Get() blocks the caller routine until the fake clock is advanced by the delay time
+func TestFakeClockGet(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1661990400, 0))
+	rl := NewRateLimiter(10, WithClock(clock)).SetBurst(10)
+	if err := rl.Get(); err != nil {
+		t.Fatalf("First request failed unexpectedly: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- rl.Get()
+	}()
+	for clock.Waiters() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	clock.Advance(99 * time.Millisecond)
+	select {
+	case <-done:
+		t.Fatalf("Get returned before the delay time is over")
+	case <-time.After(10 * time.Millisecond):
+	}
+	clock.Advance(time.Millisecond)
+	if err := <-done; err != nil {
+		t.Errorf("Get failed unexpectedly: %v", err)
+	}
+}
+
+//rate limit to 100 req/s, burst is 20, nodelay to false, driven by a fake clock
+//it is expected that a batch is delayed as a whole, and rejected if it overflows or never fits in the bucket
+func TestGetDelayN(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1661990400, 0))
+	rl := NewRateLimiter(100, WithClock(clock)).SetBurst(20)
+	if _, err := rl.GetDelayInMicrosecondsN(21); !errors.Is(err, ErrRejected) {
+		t.Errorf("Expected rejection for a batch larger than burst, got: %v", err)
+	}
+	if delay, err := rl.GetDelayInMicrosecondsN(0); delay != 0 || err != nil {
+		t.Errorf("Expected no delay for an empty batch, got: %d, %v", delay, err)
+	}
+	cases := []struct {
+		n       uint32
+		advance time.Duration
+		delay    int64
+		rejected bool
+	}{
+		{1, 0, 0, false},
+		{10, 0, 100000, false},
+		{11, 0, 0, true},
+		{10, 0, 200000, false},
+		{1, 0, 0, true},
+		{20, 200 * time.Millisecond, 200000, false},
+		{5, 50 * time.Millisecond, 200000, false},
+		//a batch on a bucket idle for long is counted except for the first request
+		{10, time.Second, 90000, false},
+		{10, 0, 190000, false},
+		{2, 0, 0, true},
+	}
+	for i, c := range cases {
+		clock.Advance(c.advance)
+		delay, err := rl.GetDelayInMicrosecondsN(c.n)
+		if delay != c.delay || errors.Is(err, ErrRejected) != c.rejected {
+			t.Errorf("Case %d: expected %d, rejected %v, got %d, %v", i, c.delay, c.rejected, delay, err)
+		}
+	}
+}
+
+//rate limit to 100 req/s, burst is 10, nodelay to false, driven by a fake clock
+//it is expected that a cancelled reservation gives back the water which has not leaked yet
+func TestReservation(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1661990400, 0))
+	rl := NewRateLimiter(100, WithClock(clock)).SetBurst(10)
+	excess := func() int64 {
+		return rl.(*rateLimiter).bucket.(*limiterRecord).load().excess
+	}
+	rl.Get()
+
+	r := rl.ReserveN(5)
+	if !r.OK() || r.Delay() != 50*time.Millisecond {
+		t.Fatalf("Unexpected reservation: %v, %v", r.OK(), r.Delay())
+	}
+	r.Cancel()
+	if excess() != 0 {
+		t.Errorf("Expected an empty bucket after cancelling, got excess: %d", excess())
+	}
+
+	//the later reservation stays on top of the earlier one
+	r1 := rl.ReserveN(3)
+	r2 := rl.ReserveN(2)
+	if r2.Delay() != 50*time.Millisecond {
+		t.Errorf("Unexpected delay: %v", r2.Delay())
+	}
+	clock.Advance(20 * time.Millisecond)
+	r1.Cancel()
+	r1.Cancel()
+	if excess() != 4000 {
+		t.Errorf("Expected 1 req refunded, got excess: %d", excess())
+	}
+	clock.Advance(30 * time.Millisecond)
+	r2.Cancel()
+	if excess() != 4000 {
+		t.Errorf("Expected nothing refunded after the delay time, got excess: %d", excess())
+	}
+
+	if r := rl.ReserveN(11); r.OK() || r.Delay() != 0 {
+		t.Errorf("Expected a rejected reservation")
+	}
+	rl.ReserveN(11).Cancel()
+}
+
+//rate limit to 100 req/s, burst is 10, nodelay to true, driven by a fake clock
+//it is expected that a rejection tells the water level and the earliest time a retry could succeed
+func TestRejectedError(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1661990400, 0))
+	rl := NewRateLimiter(100, WithClock(clock)).SetBurst(10).SetNodelay(true)
+	rl.Get()
+	if err := rl.GetN(10); err != nil {
+		t.Fatalf("Batch is rejected unexpectedly: %v", err)
+	}
+	clock.Advance(25 * time.Millisecond)
+
+	var rejected *RejectedError
+	err := rl.GetN(5)
+	if !errors.As(err, &rejected) || !errors.Is(err, ErrRejected) {
+		t.Fatalf("Expected a rejected error, got: %v", err)
+	}
+	if rejected.Excess != 7.5 || rejected.Burst != 10 || rejected.RetryAfter != 25*time.Millisecond ||
+		!rejected.RetryAt.Equal(clock.Now().Add(25*time.Millisecond)) {
+		t.Errorf("Unexpected rejected error: %+v", rejected)
+	}
+	if err.Error() != "rejected, retry after 25ms" {
+		t.Errorf("Unexpected error message: %v", err)
+	}
+
+	clock.Advance(rejected.RetryAfter - time.Millisecond)
+	if err := rl.GetN(5); err == nil {
+		t.Errorf("Batch passed before the retry time")
+	}
+	clock.Advance(time.Millisecond)
+	if err := rl.GetN(5); err != nil {
+		t.Errorf("Batch is rejected at the retry time: %v", err)
+	}
+
+	err = rl.GetN(11)
+	if !errors.As(err, &rejected) || !rejected.RetryAt.IsZero() || err.Error() != "rejected" {
+		t.Errorf("Expected a never-succeeding rejection, got: %v", err)
+	}
+}
+
+//stressDelays hammers the limiter from routineNum routines with repeatNum requests each at the same instant,
+//return the sorted delay times of the accepted requests
+func stressDelays(getDelay func() (int64, error), routineNum, repeatNum int) []int64 {
+	var (
+		mu     sync.Mutex
+		delays []int64
+	)
+	wg := sync.WaitGroup{}
+	wg.Add(routineNum)
+	for i := 0; i < routineNum; i++ {
+		go func() {
+			for i := 0; i < repeatNum; i++ {
+				if delay, err := getDelay(); err == nil {
+					mu.Lock()
+					delays = append(delays, delay)
+					mu.Unlock()
+				}
+			}
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+	sort.Slice(delays, func(i, j int) bool { return delays[i] < delays[j] })
+	return delays
+}
+
+//checkDelays checks the delays are exactly one interval apart from each other, starting from the first one
+func checkDelays(t *testing.T, delays []int64, num int, first, interval int64) {
+	t.Helper()
+	if len(delays) != num {
+		t.Fatalf("Expected %d reqs accepted, got %d", num, len(delays))
+	}
+	for i, delay := range delays {
+		if delay != first+int64(i)*interval {
+			t.Fatalf("Unexpected delay of the %dth accepted req: %d", i, delay)
+		}
+	}
+}
+
+//rate limit to 1000 req/s, burst is 100, nodelay to false, microsecond resolution, driven by a fake clock
+//64 routines are racing for the bucket, it is expected that the output rate stays exact, run it with -race
+func TestStressExactRate(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1661990400, 0))
+	rl := NewRateLimiter(1000, WithClock(clock)).SetBurst(100).SetResolution(ResolutionEnum.Microsecond)
+
+	//the first request is taken without water since the bucket has been idle
+	checkDelays(t, stressDelays(rl.GetDelayInMicroseconds, 64, 10), 101, 0, 1000)
+	for i := 0; i < 20; i++ {
+		clock.Advance(10 * time.Millisecond)
+		checkDelays(t, stressDelays(rl.GetDelayInMicroseconds, 64, 10), 10, 91000, 1000)
+	}
+}
+
+//rate limit to 100 req/s, burst is 10, nodelay to false, driven by a fake clock
+//it is expected that the water level of the bucket is kept when the rate or the resolution changes
+func TestReconfigure(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1661990400, 0))
+	rl := NewRateLimiter(100, WithClock(clock)).SetBurst(10)
+	rl.Get()
+	rl.GetDelayInMicrosecondsN(5)
+
+	cases := []struct {
+		update  func()
+		advance time.Duration
+		delay   time.Duration
+	}{
+		{func() { rl.SetResolution(ResolutionEnum.Microsecond) }, 0, 60 * time.Millisecond},
+		{func() { rl.SetRate(200) }, 0, 35 * time.Millisecond},
+		{func() { rl.SetResolution(ResolutionEnum.MicrosecondX100) }, 10 * time.Millisecond, 30 * time.Millisecond},
+		{func() { rl.SetBurst(6).SetResolution(ResolutionEnum.Millisecond) }, 0, 0},
+		{func() { rl.SetNodelay(true) }, 5 * time.Millisecond, 0},
+	}
+	for i, c := range cases {
+		c.update()
+		clock.Advance(c.advance)
+		if r := rl.Reserve(); r.Delay() != c.delay || r.OK() != (c.delay > 0 || i == 4) {
+			t.Errorf("Case %d: unexpected reservation: %v, %v", i, r.OK(), r.Delay())
+		}
+	}
+	if excess := rl.(*rateLimiter).bucket.(*limiterRecord).load().excess; excess != 6000 {
+		t.Errorf("Unexpected water level: %d", excess)
+	}
+}
+
+//the settings are changed by routines while other routines are racing for the bucket, run it with -race
+func TestStressReconfigure(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1661990400, 0))
+	rl := NewRateLimiter(1000, WithClock(clock)).SetBurst(100)
+	resolutions := []Resolution{ResolutionEnum.Microsecond, ResolutionEnum.MicrosecondX10, ResolutionEnum.MicrosecondX100, ResolutionEnum.Millisecond}
+
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		for i := 0; i < 1000; i++ {
+			rl.SetResolution(resolutions[i%len(resolutions)]).SetRate(uint32(1000 + i)).SetNodelay(i%2 == 0)
+		}
+		wg.Done()
+	}()
+	go func() {
+		for i := 0; i < 1000; i++ {
+			clock.Advance(time.Millisecond)
+		}
+		wg.Done()
+	}()
+	stressDelays(rl.GetDelayInMicroseconds, 16, 1000)
+	wg.Wait()
+
+	//the bucket is drained after a long idle time whatever the resolution is
+	clock.Advance(time.Second)
+	rl.SetResolution(ResolutionEnum.Millisecond).SetRate(1000).SetNodelay(false)
+	if delay, err := rl.GetDelayInMicroseconds(); delay != 0 || err != nil {
+		t.Errorf("Expected an empty bucket, got: %d, %v", delay, err)
+	}
+}
+
+//rate limit to 10 req/s, burst is 5, delay is 2, driven by a fake clock
+//the first 2 excess reqs are expected to pass without delay, the rest up to the burst are delayed, and the others are rejected
+func TestDelayN(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1661990400, 0))
+	rl := NewRateLimiter(10, WithClock(clock)).SetBurst(5).SetDelay(2)
+
+	//Note: the water of the first request on the empty bucket leaks out at once
+	expected := []int64{0, 0, 0, 100000, 200000, 300000}
+	for i, e := range expected {
+		if delay, err := rl.GetDelayInMicroseconds(); err != nil || delay != e {
+			t.Errorf("Unexpected delay of request %d: %d, %v", i, delay, err)
+		}
+	}
+	if _, err := rl.GetDelayInMicroseconds(); !errors.Is(err, ErrRejected) {
+		t.Errorf("Expected rejection, got: %v", err)
+	}
+	//the delay of the burst is the same as nodelay
+	clock.Advance(time.Second)
+	rl.SetDelay(5)
+	for i := 0; i < 5; i++ {
+		if delay, err := rl.GetDelayInMicroseconds(); err != nil || delay != 0 {
+			t.Errorf("Unexpected delay of request %d: %d, %v", i, delay, err)
+		}
+	}
+}
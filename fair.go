@@ -0,0 +1,194 @@
+package ratelimit
+
+/*
+Copyright (c) Yunpeng Deng(dypflying)
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//fairSweepInterval is the idle time in nanoseconds after which the drained keys stop being counted as active
+const fairSweepInterval = int64(100 * time.Millisecond)
+
+//fairSweepBatch is the number of the active keys checked by a request for the drained ones,
+//so the sweep of a zone of millions of keys costs each request the same as the sweep of a few keys
+const fairSweepBatch = 4
+
+//WithFairShare sets the zone rate limiter to share the zone rate among the active keys by their weights,
+//rather than giving each key a bucket of its own rate. The keys exceeding their shares borrow the capacity
+//the other keys leave idle, so a busy key takes the whole rate when the others are idle, and only its share
+//when the others are busy. The rates of the keys are not used in the fair share mode, while their bursts and nodelay are.
+//It is ignored by the simple rate limiter.
+func WithFairShare() Option {
+	return func(o *limiterOptions) {
+		o.fair = true
+	}
+}
+
+//NewFairZoneLimiter is the contructor for a zone rate limiter sharing the rate fairly among the active keys
+func NewFairZoneLimiter(rate uint32, opts ...Option) ZoneLimiter {
+	return NewZoneRateLimiter(rate, append(opts, WithFairShare())...)
+}
+
+//WithWeight sets the weight of a key in the fair share mode, the share of an active key is the zone rate
+//multiplied by its weight over the total weight of the active keys, default is 1
+func WithWeight(weight uint32) ItemOption {
+	return func(meta *limiterMeta) {
+		meta.weight = weight
+	}
+}
+
+//fairShare tracks the active keys of a zone rate limiter in the fair share mode
+type fairShare struct {
+	//the total weight of the active keys
+	weight int64
+	//the active items, which are checked in turns for the drained ones
+	active struct {
+		mu    sync.Mutex
+		items []*zoneItem
+		next  int
+	}
+	//the bucket of the zone rate which counts the requests of all the keys
+	bucket
+}
+
+func weightOf(meta *limiterMeta) int64 {
+	if meta.weight == 0 {
+		return 1
+	}
+	return int64(meta.weight)
+}
+
+//itemMeta returns the settings which the item is limited by, they are the settings of the item with its share of the zone rate
+//in the fair share mode, in which the item is counted as active if activate is set
+func (z *zoneRateLimiterOf[K]) itemMeta(item *zoneItem, zoneMeta *limiterMeta, activate bool) *limiterMeta {
+	meta := item.loadMeta()
+	if item == &z.overflow {
+		meta = zoneMeta
+	}
+	if !z.limiterOptions.fair {
+		return meta
+	}
+	weight := weightOf(meta)
+	if activate && atomic.CompareAndSwapInt64(&item.active, 0, weight) {
+		atomic.AddInt64(&z.fair.weight, weight)
+		z.fair.track(item)
+	}
+	total := atomic.LoadInt64(&z.fair.weight)
+	if total < weight {
+		total = weight
+	}
+	//the share is rounded up, so an active key is never starved by a large number of the keys
+	share := *meta
+	share.rate = uint32((int64(zoneMeta.rate)*weight + total - 1) / total)
+	share.window = zoneMeta.window
+	return &share
+}
+
+//deactivate stops counting the weight of the item in the fair share
+func (z *zoneRateLimiterOf[K]) deactivate(item *zoneItem) {
+	if weight := atomic.LoadInt64(&item.active); weight > 0 && atomic.CompareAndSwapInt64(&item.active, weight, 0) {
+		atomic.AddInt64(&z.fair.weight, -weight)
+	}
+}
+
+//retire stops counting the weight of the item removed from the zone, the routines still holding it never count it again
+func (z *zoneRateLimiterOf[K]) retire(item *zoneItem) {
+	if weight := atomic.SwapInt64(&item.active, -1); weight > 0 {
+		atomic.AddInt64(&z.fair.weight, -weight)
+	}
+}
+
+//track lists the activated item for the sweep unless it is listed already
+func (f *fairShare) track(item *zoneItem) {
+	if atomic.CompareAndSwapInt32(&item.listed, 0, 1) {
+		f.active.mu.Lock()
+		f.active.items = append(f.active.items, item)
+		f.active.mu.Unlock()
+	}
+}
+
+//untrack returns whether the inactive item is taken off the list, an item activated in the meantime stays
+//on the list, unless its activation has listed it again
+func untrack(item *zoneItem) bool {
+	if atomic.LoadInt64(&item.active) > 0 {
+		return false
+	}
+	atomic.StoreInt32(&item.listed, 0)
+	return atomic.LoadInt64(&item.active) <= 0 || !atomic.CompareAndSwapInt32(&item.listed, 0, 1)
+}
+
+//sweepFair stops counting the keys whose buckets have drained for the sweep interval, it checks the next fairSweepBatch active keys
+//in turns, and it is skipped while another routine holds the list. A key swept while pouring water is counted
+//again by its next requests.
+func (z *zoneRateLimiterOf[K]) sweepFair(now int64) {
+	active := &z.fair.active
+	if !active.mu.TryLock() {
+		return
+	}
+	defer active.mu.Unlock()
+	zoneMeta := z.loadMeta()
+	for i := 0; i < fairSweepBatch && len(active.items) > 0; i++ {
+		if active.next >= len(active.items) {
+			active.next = 0
+		}
+		item := active.items[active.next]
+		if atomic.LoadInt64(&item.active) > 0 {
+			if last, drained := item.idle(z.itemMeta(item, zoneMeta, false), now); drained && now-last >= fairSweepInterval {
+				z.deactivate(item)
+			}
+		}
+		if !untrack(item) {
+			active.next++
+			continue
+		}
+		last := len(active.items) - 1
+		active.items[active.next] = active.items[last]
+		active.items[last] = nil
+		active.items = active.items[:last]
+	}
+}
+
+//reserveFair pours the water into the bucket of the share of the key, the requests within the share are guaranteed,
+//and they may overdraw the zone bucket by the burst of the key, so the keys exceeding their shares borrow
+//only the capacity the others leave idle. It returns nil if the item has been evicted.
+func (z *zoneRateLimiterOf[K]) reserveFair(item *zoneItem, zoneMeta *limiterMeta, n uint32) *Reservation {
+	z.sweepFair(z.nanotime())
+	meta := z.itemMeta(item, zoneMeta, true)
+	r := item.reserveN(meta, zoneMeta.resolution, &z.limiterOptions, n)
+	if r == nil {
+		return nil
+	} else if !r.ok {
+		if borrowed := z.fair.reserveN(zoneMeta, zoneMeta.resolution, &z.limiterOptions, n); borrowed.ok {
+			return borrowed
+		}
+		return r
+	}
+	reservation := &Reservation{ok: true}
+	reservation.join(r)
+	if charged := z.fair.reserveN(overdraw(zoneMeta, meta.burst+n), zoneMeta.resolution, &z.limiterOptions, n); charged.ok {
+		reservation.children = append(reservation.children, charged)
+	}
+	return reservation
+}
@@ -0,0 +1,143 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+//offer 1 req of each key every period of it for 10 seconds, driven by a fake clock,
+//return the number of the accepted reqs of each key
+func offerKeys(clock *FakeClock, zl ZoneLimiter, periods map[string]int) map[string]int {
+	accepted := make(map[string]int)
+	for i := 0; i < 10000; i++ {
+		for key, period := range periods {
+			if i%period != 0 {
+				continue
+			}
+			if _, err := zl.GetDelayInMicroseconds(key); err == nil {
+				accepted[key]++
+			}
+		}
+		clock.Advance(time.Millisecond)
+	}
+	return accepted
+}
+
+//rate limit to 100 req/s shared by key a of weight 1 and key b of weight 3, burst is 5, nodelay, driven by a fake clock
+//the busy keys are expected to share the rate by their weights, and a key is expected to take the whole rate alone
+func TestFairShareWeights(t *testing.T) {
+	for _, algorithm := range []Algorithm{AlgorithmEnum.LeakyBucket, AlgorithmEnum.TokenBucket} {
+		clock := NewFakeClock(time.Unix(1661990400, 0))
+		zl := NewFairZoneLimiter(100, WithClock(clock), WithAlgorithm(algorithm)).SetBurst(5).SetNodelay(true)
+		zl.SetZoneItem("a", 100, 5, true)
+		zl.SetZoneItem("b", 100, 5, true, WithWeight(3))
+
+		accepted := offerKeys(clock, zl, map[string]int{"a": 1, "b": 1})
+		if accepted["a"] < 240 || accepted["a"] > 260 || accepted["b"] < 740 || accepted["b"] > 760 {
+			t.Errorf("Algorithm %d: unexpected sharing of the busy keys: %v", algorithm, accepted)
+		}
+		accepted = offerKeys(clock, zl, map[string]int{"a": 1})
+		if accepted["a"] < 990 || accepted["a"] > 1010 {
+			t.Errorf("Algorithm %d: expected key a to take the whole rate, accepted: %d", algorithm, accepted["a"])
+		}
+	}
+}
+
+//rate limit to 100 req/s shared by the keys of the same weight, nodelay, driven by a fake clock
+//a quiet key of 20 req/s is expected to be accepted in full, and a noisy key to take the rest of the rate
+func TestFairShareNoisy(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1661990400, 0))
+	zl := NewFairZoneLimiter(100, WithClock(clock)).SetBurst(1).SetNodelay(true).
+		SetUnknownKeyPolicy(UnknownKeyPolicyEnum.Create)
+
+	accepted := offerKeys(clock, zl, map[string]int{"noisy": 1, "quiet": 50})
+	if accepted["quiet"] != 200 || accepted["noisy"] < 790 || accepted["noisy"] > 810 {
+		t.Errorf("Unexpected sharing of the noisy and the quiet keys: %v", accepted)
+	}
+	//the keys are not counted as active once they are deleted
+	if err := zl.DeleteZoneItem("quiet"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	zl.(*zoneRateLimiter).evictIdle()
+	if weight := zl.(*zoneRateLimiter).fair.weight; weight != 1 {
+		t.Errorf("Unexpected total weight of the active keys: %d", weight)
+	}
+}
+
+//rate limit to 1000 req/s shared by 8 keys, burst is 10, nodelay, driven by a fake clock
+//64 routines are racing for the keys while the keys are deleted and the drained keys are swept,
+//the total weight of the active keys is expected to be consistent, run it with -race
+func TestFairShareStress(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1661990400, 0))
+	zl := NewFairZoneLimiter(1000, WithClock(clock), WithShards(4)).SetBurst(10).SetNodelay(true).
+		SetUnknownKeyPolicy(UnknownKeyPolicyEnum.Create)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			zl.DeleteZoneItem(i % 8)
+			clock.Advance(10 * time.Millisecond)
+		}
+	}()
+	stressDelays(func() (int64, error) {
+		return zl.GetDelayInMicroseconds(int(clock.Now().UnixNano()/int64(time.Millisecond)) % 8)
+	}, 64, 100)
+	<-done
+
+	z := zl.(*zoneRateLimiter)
+	var active int64
+	z.zoneMap.Range(func(key interface{}, item *zoneItem) bool {
+		if weight := item.active; weight > 0 {
+			active += weight
+		}
+		return true
+	})
+	if z.fair.weight != active {
+		t.Errorf("Inconsistent total weight of the active keys: %d, expected: %d", z.fair.weight, active)
+	}
+	//the keys are not counted as active once they are drained and swept in turns
+	clock.Advance(time.Second)
+	for i := len(z.fair.active.items)/fairSweepBatch + 1; i >= 0; i-- {
+		zl.GetDelayInMicroseconds(0)
+	}
+	if z.fair.weight != 1 {
+		t.Errorf("Unexpected total weight of the active keys: %d", z.fair.weight)
+	}
+}
+
+//rate limit to 1000 req/s shared by 1000 keys, nodelay, driven by a fake clock
+//it is expected that a request checks a bounded number of the active keys, and the drained keys are all swept in turns
+func TestFairShareSweep(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1661990400, 0))
+	zl := NewFairZoneLimiter(1000, WithClock(clock)).SetNodelay(true).SetUnknownKeyPolicy(UnknownKeyPolicyEnum.Create)
+	z := zl.(*zoneRateLimiter)
+	for key := 0; key < 1000; key++ {
+		zl.GetDelayInMicroseconds(key)
+	}
+	clock.Advance(time.Second)
+	zl.GetDelayInMicroseconds(0)
+	if z.fair.weight < 1000-fairSweepBatch {
+		t.Errorf("Expected at most %d keys swept by a request, got the total weight: %d", fairSweepBatch, z.fair.weight)
+	}
+	for i := 0; i < 1000/fairSweepBatch; i++ {
+		zl.GetDelayInMicroseconds(0)
+	}
+	if z.fair.weight != 1 || len(z.fair.active.items) != 1 {
+		t.Errorf("Expected key 0 active alone, got the total weight: %d, %d listed", z.fair.weight, len(z.fair.active.items))
+	}
+}
+
+//the zone rate of 10 req/s shared by the keys, burst is 10, the second request is delayed by 100 milliseconds
+//it is expected to be rejected by GetContext() since it can not be served before the deadline
+func TestFairShareGetContext(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1661990400, 0))
+	zl := NewFairZoneLimiter(10, WithClock(clock)).SetBurst(10).SetUnknownKeyPolicy(UnknownKeyPolicyEnum.Create)
+	if err := zl.GetContext(context.Background(), defaultKey); err != nil {
+		t.Fatalf("First request failed unexpectedly: %v", err)
+	}
+	expectDeadlineRejection(t, 10, func(ctx context.Context) error {
+		return zl.GetContext(ctx, defaultKey)
+	})
+}
@@ -0,0 +1,183 @@
+package ratelimit
+
+/*
+Copyright (c) Yunpeng Deng(dypflying)
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	//the TAT of an empty bucket, which is regarded as having been idle for long enough
+	gcraEmpty = math.MinInt64
+	//the TAT of an evicted bucket, the tombstone
+	gcraEvicted = math.MinInt64 + 1
+)
+
+//gcraBucket implements the generic cell rate algorithm, it keeps a single theoretical arrival time (TAT)
+//rather than the last timestamp and the excess of the leaky bucket, the TAT is the time when all the water
+//of the bucket has leaked out, i.e. the water level is (TAT - now) * rate. So a request is swapped in by a single
+//CAS of an int64 without allocation, and it makes the same decisions as the leaky bucket:
+//each request moves the TAT forward by the emission interval 1/rate, and the requests which would move
+//the TAT beyond now + burst/rate are rejected.
+//Unlike the leaky bucket, the TAT keeps the time to drain the bucket rather than the water level when the rate changes.
+type gcraBucket struct {
+	//the TAT in nanoseconds since the creation of the limiter
+	tat int64
+	//the created time in nanoseconds, it is the last timestamp of an empty bucket
+	created int64
+}
+
+//NewGCRALimiter is the contructor for a rate limiter of the generic cell rate algorithm
+func NewGCRALimiter(rate uint32, opts ...Option) Limiter {
+	return NewRateLimiter(rate, append(opts, WithAlgorithm(AlgorithmEnum.GCRA))...)
+}
+
+//NewGCRAZoneLimiter is the contructor for a zone rate limiter of the generic cell rate algorithm
+func NewGCRAZoneLimiter(rate uint32, opts ...Option) ZoneLimiter {
+	return NewZoneRateLimiter(rate, append(opts, WithAlgorithm(AlgorithmEnum.GCRA))...)
+}
+
+//gcraLevel returns the water level at now in units of the ticks in the period per request, as the excess of the leaky bucket
+func gcraLevel(tat int64, now int64, rate uint32, resolution Resolution) int64 {
+	if tat < now {
+		return 0
+	}
+	return int64(float64(tat-now) * float64(rate) / float64(resolution))
+}
+
+func (b *gcraBucket) reserveN(meta *limiterMeta, resolution Resolution, o *limiterOptions, n uint32) *Reservation {
+	var tat, newTat, now int64
+	if meta.rate == 0 || (n > 1 && n > meta.burst) {
+		now = o.nanotime()
+		return rejectReservation(meta.burst, resolution, unitOf(meta, resolution), gcraLevel(atomic.LoadInt64(&b.tat), now, meta.rate, resolution), -1, o)
+	}
+	if n == 0 {
+		return &Reservation{ok: true}
+	}
+	//the emission interval of a request in nanoseconds
+	interval := windowOf(meta) / int64(meta.rate)
+	increment := int64(n) * interval
+	limit := int64(meta.burst) * interval
+
+	for {
+		//the time is counted in the resolution as the leaky bucket does
+		now = o.nanotime() / resolution * resolution
+		tat = atomic.LoadInt64(&b.tat)
+		if tat == gcraEvicted {
+			return nil
+		}
+		//the TAT of an empty bucket falls behind now by a single interval at most,
+		//so that the first request passes free as the leaky bucket does, while the rest of a batch is counted
+		newTat = now - interval
+		if tat != gcraEmpty && tat > newTat {
+			newTat = tat
+		}
+		newTat += increment
+		if newTat-now > limit {
+			//wait until the TAT falls back within the limit
+			retry := (newTat - limit + resolution - 1) / resolution
+			return rejectReservation(meta.burst, resolution, unitOf(meta, resolution), gcraLevel(tat, now, meta.rate, resolution), retry, o)
+		}
+		if atomic.CompareAndSwapInt64(&b.tat, tat, newTat) {
+			break
+		}
+	}
+
+	reservation := &Reservation{
+		ok:         true,
+		bucket:     b,
+		options:    o,
+		resolution: resolution,
+		unit:       unitOf(meta, resolution),
+		burst:      meta.burst,
+		last:       newTat,
+		excess:     gcraLevel(newTat, now, meta.rate, resolution),
+		water:      newTat - now,
+	}
+	//the water below the reserved one which has not leaked yet
+	if tat > now {
+		reservation.water = newTat - tat
+	}
+	if delayed := newTat - now - int64(meta.delay)*interval; !meta.nodelay && delayed > 0 {
+		reservation.delay = delayed / int64(time.Microsecond)
+	}
+	return reservation
+}
+
+//cancel moves the TAT back by the reserved time which has not passed yet
+func (b *gcraBucket) cancel(r *Reservation) {
+	now := r.options.nanotime() / r.resolution * r.resolution
+	remaining := r.last - now
+	if remaining > r.water {
+		remaining = r.water
+	}
+	if remaining <= 0 {
+		return
+	}
+	for {
+		tat := atomic.LoadInt64(&b.tat)
+		if tat == gcraEvicted || tat == gcraEmpty {
+			return
+		}
+		if atomic.CompareAndSwapInt64(&b.tat, tat, tat-remaining) {
+			return
+		}
+	}
+}
+
+func (b *gcraBucket) idle(meta *limiterMeta, nanotime int64) (int64, bool) {
+	return b.idleAt(atomic.LoadInt64(&b.tat), nanotime)
+}
+
+//idleAt regards the TAT as the last timestamp, which is when the bucket has been drained
+func (b *gcraBucket) idleAt(tat int64, nanotime int64) (int64, bool) {
+	switch tat {
+	case gcraEmpty:
+		return b.created, true
+	case gcraEvicted:
+		return 0, true
+	}
+	return tat, tat <= nanotime
+}
+
+func (b *gcraBucket) evictIdle(meta *limiterMeta, nanotime int64, ttl time.Duration) bool {
+	for {
+		tat := atomic.LoadInt64(&b.tat)
+		if tat == gcraEvicted {
+			return false
+		}
+		last, drained := b.idleAt(tat, nanotime)
+		if !drained || nanotime-last < int64(ttl) {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&b.tat, tat, gcraEvicted) {
+			return true
+		}
+	}
+}
+
+func (b *gcraBucket) evicted() bool {
+	return atomic.LoadInt64(&b.tat) == gcraEvicted
+}
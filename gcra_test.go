@@ -0,0 +1,91 @@
+package ratelimit
+
+import (
+	"errors"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+//the GCRA and the leaky bucket limiters are driven by the same random requests on a fake clock,
+//it is expected that they make the same decisions of allowing, delaying and rejecting the requests
+func TestGCRAEquivalence(t *testing.T) {
+	gaps := []time.Duration{0, 0, 0, time.Microsecond, 70 * time.Microsecond, time.Millisecond, 3 * time.Millisecond,
+		10 * time.Millisecond, 100 * time.Millisecond, time.Second}
+	for _, c := range []struct {
+		rate       uint32
+		burst      uint32
+		nodelay    bool
+		delay      uint32
+		resolution Resolution
+		//the period of the rate, the gaps are scaled by it
+		period time.Duration
+	}{
+		{1000, 0, false, 0, ResolutionEnum.Millisecond, time.Second},
+		{1000, 10, false, 0, ResolutionEnum.Millisecond, time.Second},
+		{1000, 10, true, 0, ResolutionEnum.Millisecond, time.Second},
+		{100, 5, false, 0, ResolutionEnum.Millisecond, time.Second},
+		{10, 20, true, 0, ResolutionEnum.Millisecond, time.Second},
+		{10000, 100, false, 0, ResolutionEnum.Microsecond, time.Second},
+		{250, 3, false, 0, ResolutionEnum.MicrosecondX10, time.Second},
+		{1, 2, false, 0, ResolutionEnum.MicrosecondX100, time.Second},
+		{1000, 10, false, 4, ResolutionEnum.Millisecond, time.Second},
+		{100, 5, false, 5, ResolutionEnum.Microsecond, time.Second},
+		//the intervals above 1 hour
+		{1, 1, false, 0, ResolutionEnum.Millisecond, 3 * time.Hour},
+		{2, 0, true, 0, ResolutionEnum.Microsecond, 24 * time.Hour},
+		{5, 3, false, 1, ResolutionEnum.Millisecond, 2 * time.Hour},
+	} {
+		clock := NewFakeClock(time.Unix(1661990400, 0))
+		leaky := NewRateLimiterPer(Per(c.rate, c.period), WithClock(clock)).SetBurst(c.burst).SetNodelay(c.nodelay).SetDelay(c.delay).
+			SetResolution(c.resolution)
+		gcra := NewRateLimiterPer(Per(c.rate, c.period), WithClock(clock), WithAlgorithm(AlgorithmEnum.GCRA)).SetBurst(c.burst).
+			SetNodelay(c.nodelay).SetDelay(c.delay).SetResolution(c.resolution)
+		random := rand.New(rand.NewSource(int64(c.rate)))
+		for i := 0; i < 5000; i++ {
+			clock.Advance(gaps[random.Intn(len(gaps))] * (c.period / time.Second))
+			n := uint32(random.Intn(3) + 1)
+			expected, actual := leaky.ReserveN(n), gcra.ReserveN(n)
+			//Note: the delay of the leaky bucket is truncated from a float, which may fall behind by a microsecond
+			if diff := actual.Delay() - expected.Delay(); expected.OK() != actual.OK() || diff < 0 || diff > time.Microsecond {
+				t.Fatalf("Config %+v, request %d of %d: expected %v, %v, got %v, %v",
+					c, i, n, expected.OK(), expected.Delay(), actual.OK(), actual.Delay())
+			}
+			var expectedErr, actualErr *RejectedError
+			if errors.As(expected.err, &expectedErr) != errors.As(actual.err, &actualErr) ||
+				(expectedErr != nil && expectedErr.RetryAfter != actualErr.RetryAfter) {
+				t.Fatalf("Config %+v, request %d of %d: expected %v, got %v", c, i, n, expected.err, actual.err)
+			}
+			//some of the reservations are cancelled a moment later
+			if random.Intn(5) == 0 {
+				clock.Advance(gaps[random.Intn(len(gaps))] * (c.period / time.Second) / 10)
+				expected.Cancel()
+				actual.Cancel()
+			}
+		}
+	}
+}
+
+//the zone's rate limit to 1000 req/s, burst is 100, microsecond resolution, driven by a fake clock
+//64 routines are racing for the buckets, it is expected that the output rate stays exact as the leaky bucket, run it with -race
+func TestGCRAZoneStress(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1661990400, 0))
+	rl := NewGCRAZoneLimiter(1000, WithClock(clock)).SetBurst(100).SetResolution(ResolutionEnum.Microsecond).
+		SetUnknownKeyPolicy(UnknownKeyPolicyEnum.Create).SetIdleTTL(time.Second)
+
+	for _, key := range []interface{}{defaultKey, customizedKey} {
+		checkDelays(t, stressDelays(func() (int64, error) {
+			return rl.GetDelayInMicroseconds(key)
+		}, 64, 10), 101, 0, 1000)
+	}
+	//the buckets are evicted once they have been drained and idle for the ttl
+	z := rl.(*zoneRateLimiter)
+	clock.Advance(time.Second)
+	if n := z.evictIdle(); n != 0 {
+		t.Errorf("Expected no eviction before the ttl, got %d", n)
+	}
+	clock.Advance(100 * time.Millisecond)
+	if n := z.evictIdle(); n != 2 || rl.Len() != 0 {
+		t.Errorf("Expected 2 items evicted, got %d", n)
+	}
+}
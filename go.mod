@@ -1,5 +1,7 @@
 module github.com/dypflying/leakybucket
 
-go 1.16
+go 1.20
+
+require gopkg.in/yaml.v3 v3.0.1
 
 require golang.org/x/lint v0.0.0-20210508222113-6edffad5e616 // indirect
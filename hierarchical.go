@@ -0,0 +1,450 @@
+package ratelimit
+
+/*
+Copyright (c) Yunpeng Deng(dypflying)
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+//HierarchicalLimiter is a zone rate limiter whose keys are the classes of a tree, like the HTB classes of Linux.
+//Each class has a guaranteed rate, and borrows the idle capacity of its parent class up to its ceil rate,
+//the root class is the ceiling of all the classes.
+type HierarchicalLimiter interface {
+	ZoneLimiter
+	//AddClass adds the class of the key under the parent class, the parent is the root class if it is nil,
+	//or updates the rates of an existing class under the same parent and keeps its water level
+	AddClass(key interface{}, parent interface{}, rate uint32, ceil uint32) error
+}
+
+//htbClass is a class of the hierarchical limiter, it holds a bucket of the guaranteed rate,
+//and a bucket of the ceil rate which counts all the requests of the class once it borrows from the parent
+type htbClass struct {
+	limiterConfig
+	parent *htbClass
+	//the number of the child classes, guarded by the mutex of the limiter
+	children int
+	assured  bucket
+	ceiled   bucket
+}
+
+type hierarchicalLimiter struct {
+	limiterOptions
+	//the root class, its settings are the defaults of the new classes, and it holds the zone-wide settings as well
+	root    htbClass
+	mu      sync.RWMutex
+	classes map[interface{}]*htbClass
+}
+
+//NewHierarchicalLimiter is the contructor for a hierarchical limiter, the rate is the one of the root class
+func NewHierarchicalLimiter(rate uint32, opts ...Option) HierarchicalLimiter {
+	h := &hierarchicalLimiter{classes: make(map[interface{}]*htbClass)}
+	h.limiterOptions = newLimiterOptions(opts)
+	h.root.storeMeta(&limiterMeta{
+		rate:       rate,
+		resolution: ResolutionEnum.Millisecond,
+	})
+	h.root.assured = h.newBucket(0)
+	return h
+}
+
+//ceilMeta returns the settings of the bucket of the ceil rate, which is nil if the class has no ceil of its own,
+//and whether the class borrows from its parent. A zero ceil means the class borrows up to the ceil of its parent,
+//and a class never borrows if its ceil is not above its rate.
+func ceilMeta(meta *limiterMeta) (*limiterMeta, bool) {
+	if meta.ceil == 0 {
+		return nil, true
+	} else if meta.ceil <= meta.rate {
+		return nil, false
+	}
+	ceil := *meta
+	ceil.rate = meta.ceil
+	return &ceil, true
+}
+
+func (h *hierarchicalLimiter) newClass(parent *htbClass, rate uint32, ceil uint32, burst uint32, nodelay bool) *htbClass {
+	class := &htbClass{parent: parent}
+	class.storeMeta(&limiterMeta{
+		nodelay: nodelay,
+		delay:   h.root.loadMeta().delay,
+		rate:    rate,
+		burst:   burst,
+		window:  h.root.loadMeta().window,
+		ceil:    ceil,
+	})
+	class.assured = h.newBucket(h.nanotime())
+	class.ceiled = h.newBucket(h.nanotime())
+	parent.children++
+	return class
+}
+
+func (h *hierarchicalLimiter) AddClass(key interface{}, parent interface{}, rate uint32, ceil uint32) error {
+	if h == nil || key == nil {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	p := &h.root
+	if parent != nil {
+		var ok bool
+		if p, ok = h.classes[parent]; !ok {
+			return errors.New("parent not exists")
+		}
+	}
+	if class, ok := h.classes[key]; ok {
+		if class.parent != p {
+			return errors.New("class exists under another parent")
+		}
+		class.updateMeta(func(meta *limiterMeta) {
+			meta.rate = rate
+			meta.ceil = ceil
+		})
+		return nil
+	}
+	meta := h.root.loadMeta()
+	h.classes[key] = h.newClass(p, rate, ceil, meta.burst, meta.nodelay)
+	return nil
+}
+
+//AddZoneItem adds the class of the key under the root class without a guaranteed rate,
+//so it borrows up to the rate of the root class
+func (h *hierarchicalLimiter) AddZoneItem(key interface{}) error {
+	if h == nil || key == nil {
+		return nil
+	}
+	_, err := h.addClass(key)
+	return err
+}
+
+//addClass adds the class of the key under the root class, and returns the class of the key either added or found,
+//so the class is not looked up again after the lock is released
+func (h *hierarchicalLimiter) addClass(key interface{}) (*htbClass, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if class, ok := h.classes[key]; ok {
+		return class, errors.New("key exists")
+	}
+	meta := h.root.loadMeta()
+	if meta.maxEntries > 0 && len(h.classes) >= meta.maxEntries {
+		return nil, ErrZoneFull
+	}
+	class := h.newClass(&h.root, 0, 0, meta.burst, meta.nodelay)
+	h.classes[key] = class
+	return class, nil
+}
+
+//DeleteZoneItem deletes the class of the key, the classes having child classes can not be deleted
+func (h *hierarchicalLimiter) DeleteZoneItem(key interface{}) error {
+	if h == nil || key == nil {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	class, ok := h.classes[key]
+	if !ok {
+		return errors.New("key not exists")
+	} else if class.children > 0 {
+		return errors.New("class has children")
+	}
+	delete(h.classes, key)
+	class.parent.children--
+	return nil
+}
+
+//SetZoneItem replaces the guaranteed rate, the burst and the nodelay of an existing class and keeps its water level,
+//or adds the class under the root class with the settings
+func (h *hierarchicalLimiter) SetZoneItem(key interface{}, rate uint32, burst uint32, nodelay bool, opts ...ItemOption) {
+	if h == nil || key == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if class, ok := h.classes[key]; ok {
+		class.updateMeta(func(meta *limiterMeta) {
+			meta.rate = rate
+			meta.burst = burst
+			meta.nodelay = nodelay
+			for _, opt := range opts {
+				opt(meta)
+			}
+		})
+		return
+	}
+	class := h.newClass(&h.root, rate, 0, burst, nodelay)
+	class.updateMeta(func(meta *limiterMeta) {
+		for _, opt := range opts {
+			opt(meta)
+		}
+	})
+	h.classes[key] = class
+}
+
+//loadClass returns the class of the key, or nil if the key is not limited,
+//or the error if the key is rejected according to the unknown key policy or the max entries
+func (h *hierarchicalLimiter) loadClass(key interface{}) (*htbClass, error) {
+	h.mu.RLock()
+	class, ok := h.classes[key]
+	h.mu.RUnlock()
+	if ok {
+		return class, nil
+	}
+	meta := h.root.loadMeta()
+	switch meta.unknownKey {
+	case UnknownKeyPolicyEnum.Deny:
+		return nil, errUnknownKeyRejected
+	case UnknownKeyPolicyEnum.Create:
+		class, err := h.addClass(key)
+		if err == ErrZoneFull {
+			//the classes are never evicted, so the new keys of a full zone either share the root class or are rejected
+			if meta.overflow == OverflowPolicyEnum.Shared {
+				return &h.root, nil
+			}
+			return nil, errZoneFullRejected
+		}
+		//the class deleted in the meantime still limits the request
+		return class, nil
+	}
+	return nil, nil
+}
+
+//ReserveN pours the water into the bucket of the guaranteed rate of the class, or borrows from the ancestors if the bucket rejects.
+//The requests borrowing from the parent are counted by the bucket of the ceil rate of the class first,
+//and the guaranteed requests are counted by the ancestors as well, while they are never rejected by the ancestors.
+//The water already poured is given back if the requests are rejected at last.
+func (h *hierarchicalLimiter) ReserveN(key interface{}, n uint32) *Reservation {
+	if key == nil {
+		//do nothing
+		return &Reservation{ok: true}
+	}
+	class, err := h.loadClass(key)
+	if err != nil {
+		return &Reservation{err: err}
+	} else if class == nil {
+		return &Reservation{ok: true}
+	}
+	resolution := h.root.loadMeta().resolution
+	reservation := &Reservation{ok: true}
+	for {
+		meta := class.loadMeta()
+		r := class.assured.reserveN(meta, resolution, &h.limiterOptions, n)
+		if r.ok {
+			reservation.join(r)
+			h.charge(reservation, class, resolution, n)
+			return reservation
+		}
+		ceil, borrow := ceilMeta(meta)
+		if class.parent == nil || !borrow {
+			reservation.Cancel()
+			return &Reservation{err: r.err}
+		}
+		if ceil != nil {
+			if r = class.ceiled.reserveN(ceil, resolution, &h.limiterOptions, n); !r.ok {
+				reservation.Cancel()
+				return &Reservation{err: r.err}
+			}
+			reservation.join(r)
+		}
+		class = class.parent
+	}
+}
+
+//charge counts the guaranteed requests of the class by the bucket of its ceil rate and by the ancestors.
+//The requests may overdraw the buckets by the burst of the class, so the ancestors lend nothing
+//until the overdrawn water leaks out, and the delays of the buckets do not hold the guaranteed requests.
+func (h *hierarchicalLimiter) charge(reservation *Reservation, class *htbClass, resolution Resolution, n uint32) {
+	overdraft := class.loadMeta().burst + n
+	for c := class; c != nil; c = c.parent {
+		meta := c.loadMeta()
+		if c != class {
+			if r := c.assured.reserveN(overdraw(meta, overdraft), resolution, &h.limiterOptions, n); r.ok {
+				reservation.children = append(reservation.children, r)
+			}
+		}
+		if ceil, _ := ceilMeta(meta); ceil != nil && c.parent != nil {
+			if r := c.ceiled.reserveN(overdraw(ceil, overdraft), resolution, &h.limiterOptions, n); r.ok {
+				reservation.children = append(reservation.children, r)
+			}
+		}
+	}
+}
+
+//overdraw returns the settings of a bucket which holds the overdraft beyond its burst
+func overdraw(meta *limiterMeta, overdraft uint32) *limiterMeta {
+	debt := *meta
+	debt.burst += overdraft
+	return &debt
+}
+
+func (h *hierarchicalLimiter) Reserve(key interface{}) *Reservation {
+	return h.ReserveN(key, 1)
+}
+
+func (h *hierarchicalLimiter) GetDelayInMicroseconds(key interface{}) (int64, error) {
+	return h.GetDelayInMicrosecondsN(key, 1)
+}
+
+func (h *hierarchicalLimiter) GetDelayInMicrosecondsN(key interface{}, n uint32) (int64, error) {
+	r := h.ReserveN(key, n)
+	if !r.ok {
+		return 0, r.err
+	}
+	return r.delay, nil
+}
+
+func (h *hierarchicalLimiter) Get(key interface{}) error {
+	return h.GetN(key, 1)
+}
+
+func (h *hierarchicalLimiter) GetN(key interface{}, n uint32) error {
+	delay, err := h.GetDelayInMicrosecondsN(key, n)
+	if err != nil {
+		return err
+	} else if delay > 0 {
+		h.clock.Sleep(time.Duration(delay) * time.Microsecond)
+	}
+	return nil
+}
+
+func (h *hierarchicalLimiter) GetContext(ctx context.Context, key interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return waitReservation(ctx, h.clock, h.Reserve(key))
+}
+
+//SetRate sets the rate of the root class, which is the ceiling of all the classes
+func (h *hierarchicalLimiter) SetRate(rate uint32) ZoneLimiter {
+	if h != nil {
+		h.root.updateMeta(func(meta *limiterMeta) {
+			meta.rate = rate
+		})
+	}
+	return h
+}
+
+//SetRatePer sets the rate of the root class as a count of requests per period, the new classes take the period as well
+func (h *hierarchicalLimiter) SetRatePer(rate Rate) ZoneLimiter {
+	if h != nil {
+		h.root.updateMeta(rate.apply)
+	}
+	return h
+}
+
+//SetBurst sets the burst of the root class, which is the default of the new classes
+func (h *hierarchicalLimiter) SetBurst(burst uint32) ZoneLimiter {
+	if h != nil {
+		h.root.updateMeta(func(meta *limiterMeta) {
+			meta.burst = burst
+		})
+	}
+	return h
+}
+
+//SetNodelay sets the nodelay of the root class, which is the default of the new classes
+func (h *hierarchicalLimiter) SetNodelay(nodelay bool) ZoneLimiter {
+	if h != nil {
+		h.root.updateMeta(func(meta *limiterMeta) {
+			meta.nodelay = nodelay
+		})
+	}
+	return h
+}
+
+//SetDelay sets the delay of the root class, which is the default of the new classes
+func (h *hierarchicalLimiter) SetDelay(delay uint32) ZoneLimiter {
+	if h != nil {
+		h.root.updateMeta(func(meta *limiterMeta) {
+			meta.delay = delay
+		})
+	}
+	return h
+}
+
+//SetResolution sets the resolution of all the classes
+func (h *hierarchicalLimiter) SetResolution(resolution Resolution) ZoneLimiter {
+	if h != nil {
+		h.root.updateMeta(func(meta *limiterMeta) {
+			meta.resolution = resolution
+		})
+	}
+	return h
+}
+
+func (h *hierarchicalLimiter) SetUnknownKeyPolicy(policy UnknownKeyPolicy) ZoneLimiter {
+	if h != nil {
+		h.root.updateMeta(func(meta *limiterMeta) {
+			meta.unknownKey = policy
+		})
+	}
+	return h
+}
+
+//SetIdleTTL takes no effect, the classes are never evicted
+func (h *hierarchicalLimiter) SetIdleTTL(ttl time.Duration) ZoneLimiter {
+	return h
+}
+
+//SetMaxEntries sets the max number of the classes, the new keys of a full zone are not added
+func (h *hierarchicalLimiter) SetMaxEntries(max int) ZoneLimiter {
+	if h != nil {
+		h.root.updateMeta(func(meta *limiterMeta) {
+			meta.maxEntries = max
+		})
+	}
+	return h
+}
+
+//SetOverflowPolicy sets how the new keys are treated when the zone is full, they share the root class under the shared policy,
+//or they are rejected otherwise
+func (h *hierarchicalLimiter) SetOverflowPolicy(policy OverflowPolicy) ZoneLimiter {
+	if h != nil {
+		h.root.updateMeta(func(meta *limiterMeta) {
+			meta.overflow = policy
+		})
+	}
+	return h
+}
+
+//Len returns the number of the classes other than the root class
+func (h *hierarchicalLimiter) Len() int {
+	if h == nil {
+		return 0
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.classes)
+}
+
+//StartJanitor does nothing, the classes are never evicted
+func (h *hierarchicalLimiter) StartJanitor(interval time.Duration) {
+}
+
+//StopJanitor does nothing, the classes are never evicted
+func (h *hierarchicalLimiter) StopJanitor() {
+}
+
+func (h *hierarchicalLimiter) Close() error {
+	return nil
+}
@@ -0,0 +1,193 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//offer 1 req every millisecond for each busy class of a hierarchical limiter for 10 seconds, driven by a fake clock,
+//return the number of the accepted reqs of each class
+func offerClasses(clock *FakeClock, hl HierarchicalLimiter, busy ...string) map[string]int {
+	accepted := make(map[string]int)
+	for i := 0; i < 10000; i++ {
+		for _, key := range busy {
+			if _, err := hl.GetDelayInMicroseconds(key); err == nil {
+				accepted[key]++
+			}
+		}
+		clock.Advance(time.Millisecond)
+	}
+	return accepted
+}
+
+//the root class of 10 req/s, class a of 2 req/s with a ceil of 6 req/s, class b of 2 req/s borrowing up to the root, nodelay
+//a busy class is expected to borrow the idle capacity up to its ceil, and the busy classes are expected to get their rates,
+//while the spare capacity is lent to the class asking first, up to its ceil
+func TestHierarchicalBorrowing(t *testing.T) {
+	for _, algorithm := range []Algorithm{AlgorithmEnum.LeakyBucket, AlgorithmEnum.TokenBucket, AlgorithmEnum.GCRA} {
+		clock := NewFakeClock(time.Unix(1661990400, 0))
+		hl := NewHierarchicalLimiter(10, WithClock(clock), WithAlgorithm(algorithm))
+		hl.SetBurst(1).SetNodelay(true)
+		if err := hl.AddClass("a", nil, 2, 6); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if err := hl.AddClass("b", nil, 2, 0); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		if accepted := offerClasses(clock, hl, "a"); accepted["a"] < 58 || accepted["a"] > 63 {
+			t.Errorf("Algorithm %d: expected class a to borrow up to its ceil, accepted: %d", algorithm, accepted["a"])
+		}
+		clock.Advance(time.Second)
+		if accepted := offerClasses(clock, hl, "b"); accepted["b"] < 97 || accepted["b"] > 104 {
+			t.Errorf("Algorithm %d: expected class b to borrow up to the root, accepted: %d", algorithm, accepted["b"])
+		}
+		//class b asking first takes the whole spare capacity, and class a gets its rate
+		clock.Advance(time.Second)
+		accepted := offerClasses(clock, hl, "b", "a")
+		if accepted["a"] < 19 || accepted["a"] > 21 || accepted["b"] < 78 || accepted["b"] > 81 {
+			t.Errorf("Algorithm %d: expected class b to take the spare capacity, accepted: %v", algorithm, accepted)
+		}
+		//class a asking first borrows up to its ceil, and class b takes the rest of the root
+		accepted = offerClasses(clock, hl, "a", "b")
+		if accepted["a"] < 45 || accepted["a"] > 61 || accepted["b"] < 39 || accepted["a"]+accepted["b"] < 99 ||
+			accepted["a"]+accepted["b"] > 104 {
+			t.Errorf("Algorithm %d: expected class a to borrow up to its ceil, accepted: %v", algorithm, accepted)
+		}
+		//class a without the ceil takes the whole spare capacity asking first
+		if err := hl.AddClass("a", nil, 2, 0); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		accepted = offerClasses(clock, hl, "a", "b")
+		if accepted["a"] < 78 || accepted["a"] > 81 || accepted["b"] < 19 || accepted["b"] > 21 {
+			t.Errorf("Algorithm %d: expected class a to take the spare capacity, accepted: %v", algorithm, accepted)
+		}
+	}
+}
+
+//a class without a guaranteed rate borrowing through its parent class from the root class, nodelay, driven by a fake clock
+//the water poured into the bucket of the ceil rate of the class is expected to be given back once the root rejects the requests
+func TestHierarchicalRollback(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1661990400, 0))
+	hl := NewHierarchicalLimiter(10, WithClock(clock), WithAlgorithm(AlgorithmEnum.TokenBucket))
+	hl.SetBurst(2).SetNodelay(true)
+	if err := hl.AddClass("tenant", nil, 10, 0); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := hl.AddClass("user", "tenant", 0, 2); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	hl.SetZoneItem("tenant", 10, 3, true)
+	hl.SetZoneItem("user", 0, 1, true)
+
+	//the guaranteed reqs of the tenant overdraw the root
+	for i := 0; i < 3; i++ {
+		if _, err := hl.GetDelayInMicroseconds("tenant"); err != nil {
+			t.Fatalf("Request %d is rejected unexpectedly: %v", i, err)
+		}
+	}
+	if _, err := hl.GetDelayInMicroseconds("user"); !errors.Is(err, ErrRejected) {
+		t.Fatalf("Expected rejection by the root, got: %v", err)
+	}
+	//the root and the tenant have room for 1 req after 200ms, while the ceil of the user is refilled after 500ms
+	clock.Advance(200 * time.Millisecond)
+	if _, err := hl.GetDelayInMicroseconds("user"); err != nil {
+		t.Errorf("Expected the ceil of the user to be given back, got: %v", err)
+	}
+	if _, err := hl.GetDelayInMicroseconds("user"); !errors.Is(err, ErrRejected) {
+		t.Errorf("Expected rejection by the ceil of the user, got: %v", err)
+	}
+}
+
+//the classes are expected to be added under the existing parents only, and deleted when they have no children
+func TestHierarchicalClasses(t *testing.T) {
+	hl := NewHierarchicalLimiter(10)
+	if err := hl.AddClass("user", "tenant", 1, 2); err == nil {
+		t.Errorf("Expected error of the unknown parent")
+	}
+	if err := hl.AddClass("tenant", nil, 5, 10); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := hl.AddClass("user", "tenant", 1, 2); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := hl.AddClass("user", nil, 1, 2); err == nil {
+		t.Errorf("Expected error of moving the class")
+	}
+	if err := hl.AddClass("user", "tenant", 2, 4); err != nil {
+		t.Errorf("Unexpected error of updating the class: %v", err)
+	}
+	if err := hl.AddZoneItem("user"); err == nil {
+		t.Errorf("Expected error of the existing key")
+	}
+	if err := hl.DeleteZoneItem("tenant"); err == nil {
+		t.Errorf("Expected error of deleting the class having children")
+	}
+	if hl.Len() != 2 {
+		t.Errorf("Unexpected number of classes: %d", hl.Len())
+	}
+	if err := hl.DeleteZoneItem("user"); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if err := hl.DeleteZoneItem("tenant"); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	hl.SetUnknownKeyPolicy(UnknownKeyPolicyEnum.Deny)
+	if err := hl.Get("unknown"); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Expected rejection of the unknown key, got: %v", err)
+	}
+	hl.SetUnknownKeyPolicy(UnknownKeyPolicyEnum.Create).SetMaxEntries(1)
+	if err := hl.Get("first"); err != nil || hl.Len() != 1 {
+		t.Errorf("Expected the unknown key to be added, got: %v, %d", err, hl.Len())
+	}
+	if err := hl.Get("second"); !errors.Is(err, ErrZoneFull) {
+		t.Errorf("Expected rejection of the full zone, got: %v", err)
+	}
+}
+
+//the root class of 10 req/s, burst is 0, nodelay, the classes are created on first use, driven by a fake clock
+//64 routines are racing for the classes while they are deleted, the requests are expected to be limited by the root
+//even if their classes are deleted in the meantime, run it with -race
+func TestHierarchicalCreateStress(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1661990400, 0))
+	hl := NewHierarchicalLimiter(10, WithClock(clock))
+	hl.SetNodelay(true).SetUnknownKeyPolicy(UnknownKeyPolicyEnum.Create)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			hl.DeleteZoneItem(i % 4)
+		}
+	}()
+	var next int64
+	delays := stressDelays(func() (int64, error) {
+		return hl.GetDelayInMicroseconds(int(atomic.AddInt64(&next, 1) % 4))
+	}, 64, 100)
+	<-done
+	if len(delays) != 1 {
+		t.Errorf("Expected 1 req accepted by the root, got: %d", len(delays))
+	}
+}
+
+//a class of 10 req/s under the root of 10 req/s, burst is 10, the second request is delayed by 100 milliseconds
+//it is expected to be rejected by GetContext() since it can not be served before the deadline
+func TestHierarchicalGetContext(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1661990400, 0))
+	hl := NewHierarchicalLimiter(10, WithClock(clock))
+	hl.SetBurst(10)
+	if err := hl.AddClass("tenant", nil, 10, 0); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	hl.SetZoneItem("tenant", 10, 10, false)
+	if err := hl.GetContext(context.Background(), "tenant"); err != nil {
+		t.Fatalf("First request failed unexpectedly: %v", err)
+	}
+	expectDeadlineRejection(t, 10, func(ctx context.Context) error {
+		return hl.GetContext(ctx, "tenant")
+	})
+}
@@ -23,8 +23,15 @@ SOFTWARE.
 */
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unsafe"
 )
 
 //Resolution defines the resolution precision of a rate limiter
@@ -45,19 +52,121 @@ var ResolutionEnum = &resolutionDefs{
 	Millisecond:     Resolution(time.Millisecond), //the default
 }
 
+//Algorithm defines the counting algorithm of a rate limiter
+type Algorithm int
+
+type algorithmDefs struct {
+	LeakyBucket   Algorithm
+	TokenBucket   Algorithm
+	GCRA          Algorithm
+	SlidingWindow Algorithm
+	SlidingLog    Algorithm
+	Quota         Algorithm
+}
+
+//AlgorithmEnum defines the algorithms that can be used for rate limiting
+var AlgorithmEnum = &algorithmDefs{
+	LeakyBucket: 0, //the default, ported from the nginx's rate limiter
+	TokenBucket: 1, //the idle time builds up the burst credit that can be spent instantly
+	GCRA:        2, //the generic cell rate algorithm, makes the same decisions as the leaky bucket with a single timestamp
+	//the window algorithms limit the number of requests in a rolling window, without delay
+	SlidingWindow: 3, //the approximate count weighted from the previous fixed window
+	SlidingLog:    4, //the exact count by logging the time of each request
+	Quota:         5, //the count in the fixed calendar windows, e.g. the daily quota
+}
+
+//UnknownKeyPolicy defines how a zone rate limiter treats the keys which have never been added
+type UnknownKeyPolicy int
+
+type unknownKeyPolicyDefs struct {
+	Allow  UnknownKeyPolicy
+	Deny   UnknownKeyPolicy
+	Create UnknownKeyPolicy
+}
+
+//UnknownKeyPolicyEnum defines the 3 policies for the unknown keys of a zone rate limiter
+var UnknownKeyPolicyEnum = &unknownKeyPolicyDefs{
+	Allow:  0, //the default, no limit for the unknown keys
+	Deny:   1, //reject all requests of the unknown keys
+	Create: 2, //add the unknown keys with the zone settings on first use
+}
+
+//OverflowPolicy defines how a zone rate limiter treats the new keys when it holds the max entries
+type OverflowPolicy int
+
+type overflowPolicyDefs struct {
+	EvictLRU OverflowPolicy
+	Reject   OverflowPolicy
+	Shared   OverflowPolicy
+}
+
+//OverflowPolicyEnum defines the 3 policies for the new keys of a full zone rate limiter
+var OverflowPolicyEnum = &overflowPolicyDefs{
+	EvictLRU: 0, //the default, evict the least recently used key of the default settings whose bucket holds no water, approximated by sampling the keys
+	Reject:   1, //reject the new keys
+	Shared:   2, //limit the new keys by a single bucket shared among them
+}
+
 var (
-	errorReject = errors.New("rejected")
+	//ErrRejected is the error of the rejected requests, it is returned wrapped in a *RejectedError,
+	//so check it by errors.Is(err, ErrRejected)
+	ErrRejected = errors.New("rejected")
+	//ErrUnknownKey is the error of the unknown keys denied by a zone rate limiter, it is returned along with ErrRejected
+	ErrUnknownKey = errors.New("unknown key")
+	//ErrZoneFull is the error of the new keys which can not be added to a full zone rate limiter,
+	//it is returned along with ErrRejected for the requests of the keys
+	ErrZoneFull = errors.New("zone is full")
+
+	errUnknownKeyRejected = fmt.Errorf("%w: %w", ErrRejected, ErrUnknownKey)
+	errZoneFullRejected   = fmt.Errorf("%w: %w", ErrRejected, ErrZoneFull)
 )
 
+//RejectedError is returned when the requests are rejected, it tells when the caller could retry,
+//e.g. for a Retry-After header of HTTP.
+type RejectedError struct {
+	//the water level of the bucket in requests at the time of rejection
+	Excess float64
+	//the capacity of the bucket
+	Burst uint32
+	//the earliest time a retry could succeed, zero value if the requests can never be accepted with the current settings
+	RetryAt time.Time
+	//the time span from the rejection to RetryAt
+	RetryAfter time.Duration
+}
+
+func (e *RejectedError) Error() string {
+	if e.RetryAt.IsZero() {
+		return ErrRejected.Error()
+	}
+	return fmt.Sprintf("%v, retry after %v", ErrRejected, e.RetryAfter)
+}
+
+func (e *RejectedError) Unwrap() error {
+	return ErrRejected
+}
+
 //Limiter defines a default rate limiter
 type Limiter interface {
 	//return the delay time in micro seconds, and the error if rejected
 	GetDelayInMicroseconds() (int64, error)
+	//return the delay time in micro seconds for a batch of n requests, and the error if rejected
+	GetDelayInMicrosecondsN(n uint32) (int64, error)
 	//this will block the caller routine to a delay time if throtted, return error if it is rejected.
 	Get() error
+	//same as Get(), but takes a batch of n requests at once.
+	GetN(n uint32) error
+	//reserve the bucket for a request, which can be cancelled later if the request is not going to happen.
+	Reserve() *Reservation
+	//same as Reserve(), but reserves the bucket for a batch of n requests.
+	ReserveN(n uint32) *Reservation
+	//same as Get(), but returns ctx.Err() if the context is done before the delay time is over,
+	//and rejects immediately if the delay time would run past the context deadline.
+	GetContext(ctx context.Context) error
 	SetRate(rate uint32) Limiter
+	SetRatePer(rate Rate) Limiter
 	SetBurst(burst uint32) Limiter
 	SetNodelay(nodelay bool) Limiter
+	SetDelay(delay uint32) Limiter
 	SetResolution(resolution Resolution) Limiter
 }
 
@@ -67,27 +176,536 @@ type ZoneLimiter interface {
 	//return the delay time in micro seconds, and the error if rejected
 	GetDelayInMicroseconds(key interface{}) (int64, error)
 	//throttle with a specific key
+	//return the delay time in micro seconds for a batch of n requests, and the error if rejected
+	GetDelayInMicrosecondsN(key interface{}, n uint32) (int64, error)
+	//throttle with a specific key
 	//this will block the caller routine to a delay time if throtted, return error if it is rejected.
 	Get(key interface{}) error
+	//throttle with a specific key
+	//same as Get(key), but takes a batch of n requests at once.
+	GetN(key interface{}, n uint32) error
+	//throttle with a specific key
+	//reserve the bucket for a request, which can be cancelled later if the request is not going to happen.
+	Reserve(key interface{}) *Reservation
+	//throttle with a specific key
+	//same as Reserve(key), but reserves the bucket for a batch of n requests.
+	ReserveN(key interface{}, n uint32) *Reservation
+	//throttle with a specific key
+	//same as Get(key), but returns ctx.Err() if the context is done before the delay time is over,
+	//and rejects immediately if the delay time would run past the context deadline.
+	GetContext(ctx context.Context, key interface{}) error
 	SetRate(rate uint32) ZoneLimiter
+	SetRatePer(rate Rate) ZoneLimiter
 	SetBurst(burst uint32) ZoneLimiter
 	SetNodelay(nodelay bool) ZoneLimiter
+	SetDelay(delay uint32) ZoneLimiter
 	SetResolution(resolution Resolution) ZoneLimiter
+	SetUnknownKeyPolicy(policy UnknownKeyPolicy) ZoneLimiter
+	SetIdleTTL(ttl time.Duration) ZoneLimiter
+	SetMaxEntries(max int) ZoneLimiter
+	SetOverflowPolicy(policy OverflowPolicy) ZoneLimiter
+	//return the number of the keys held by the zone.
+	Len() int
 	AddZoneItem(key interface{}) error
 	DeleteZoneItem(key interface{}) error
-	SetZoneItem(key interface{}, rate uint32, burst uint32, nodelay bool)
+	//customize the settings of the key, the item options, e.g. WithWeight(), apply to the key as well.
+	SetZoneItem(key interface{}, rate uint32, burst uint32, nodelay bool, opts ...ItemOption)
+	//start a routine evicting the drained items which have been idle for the ttl every interval.
+	StartJanitor(interval time.Duration)
+	//stop the janitor routine and wait for it to exit.
+	StopJanitor()
+	//same as StopJanitor().
+	Close() error
+}
+
+//ZoneLimiterOf defines a rate limiter which can be used for specific keys of the comparable type K,
+//it has the same semantics as ZoneLimiter without boxing the keys into interfaces.
+type ZoneLimiterOf[K comparable] interface {
+	//throttle with a specific key
+	//return the delay time in micro seconds, and the error if rejected
+	GetDelayInMicroseconds(key K) (int64, error)
+	//throttle with a specific key
+	//return the delay time in micro seconds for a batch of n requests, and the error if rejected
+	GetDelayInMicrosecondsN(key K, n uint32) (int64, error)
+	//throttle with a specific key
+	//this will block the caller routine to a delay time if throtted, return error if it is rejected.
+	Get(key K) error
+	//throttle with a specific key
+	//same as Get(key), but takes a batch of n requests at once.
+	GetN(key K, n uint32) error
+	//throttle with a specific key
+	//reserve the bucket for a request, which can be cancelled later if the request is not going to happen.
+	Reserve(key K) *Reservation
+	//throttle with a specific key
+	//same as Reserve(key), but reserves the bucket for a batch of n requests.
+	ReserveN(key K, n uint32) *Reservation
+	//throttle with a specific key
+	//same as Get(key), but returns ctx.Err() if the context is done before the delay time is over,
+	//and rejects immediately if the delay time would run past the context deadline.
+	GetContext(ctx context.Context, key K) error
+	SetRate(rate uint32) ZoneLimiterOf[K]
+	SetRatePer(rate Rate) ZoneLimiterOf[K]
+	SetBurst(burst uint32) ZoneLimiterOf[K]
+	SetNodelay(nodelay bool) ZoneLimiterOf[K]
+	SetDelay(delay uint32) ZoneLimiterOf[K]
+	SetResolution(resolution Resolution) ZoneLimiterOf[K]
+	SetUnknownKeyPolicy(policy UnknownKeyPolicy) ZoneLimiterOf[K]
+	SetIdleTTL(ttl time.Duration) ZoneLimiterOf[K]
+	SetMaxEntries(max int) ZoneLimiterOf[K]
+	SetOverflowPolicy(policy OverflowPolicy) ZoneLimiterOf[K]
+	//return the number of the keys held by the zone.
+	Len() int
+	AddZoneItem(key K) error
+	DeleteZoneItem(key K) error
+	//customize the settings of the key, the item options, e.g. WithWeight(), apply to the key as well.
+	SetZoneItem(key K, rate uint32, burst uint32, nodelay bool, opts ...ItemOption)
+	//start a routine evicting the drained items which have been idle for the ttl every interval.
+	StartJanitor(interval time.Duration)
+	//stop the janitor routine and wait for it to exit.
+	StopJanitor()
+	//same as StopJanitor().
+	Close() error
+}
+
+//Option defines an optional setting applied to a rate limiter at construction
+type Option func(*limiterOptions)
+
+//ItemOption defines an optional setting applied to a key by SetZoneItem()
+type ItemOption func(*limiterMeta)
+
+//WithDelay sets the number of the excess requests of a key passing without delay, see SetDelay()
+func WithDelay(delay uint32) ItemOption {
+	return func(meta *limiterMeta) {
+		meta.delay = delay
+	}
+}
+
+type limiterOptions struct {
+	clock     Clock
+	algorithm Algorithm
+	//the calendar windows of the quota algorithm
+	quota quotaOptions
+	//the number of the shards of a zone's store, the sync.Map store is used if it is not set
+	shards int
+	//whether the zone rate is shared fairly among the active keys
+	fair bool
+	//the reference points of the elapsed time, taken at the creation of the limiter
+	epoch     time.Time
+	epochMono time.Duration
+	mono      MonotonicClock
+	steady    *steadyTime
+}
+
+//steadyTime keeps the elapsed time read from a clock without monotonic readings from going back
+type steadyTime struct {
+	mu     sync.Mutex
+	last   time.Duration
+	offset time.Duration
+}
+
+//WithClock sets the time source of a rate limiter, default is the system clock
+func WithClock(clock Clock) Option {
+	return func(o *limiterOptions) {
+		if clock != nil {
+			o.clock = clock
+		}
+	}
+}
+
+//WithAlgorithm sets the counting algorithm of a rate limiter, default is the leaky bucket
+func WithAlgorithm(algorithm Algorithm) Option {
+	return func(o *limiterOptions) {
+		o.algorithm = algorithm
+	}
+}
+
+//WithShards sets the zone rate limiter to hold the keys in a store partitioned by hash into the shards,
+//which suits the keys constantly added and deleted, e.g. the client IPs, better than the default sync.Map.
+//The number of shards is rounded up to a power of 2, it is ignored by the simple rate limiter.
+func WithShards(shards int) Option {
+	return func(o *limiterOptions) {
+		o.shards = shards
+	}
+}
+
+func newLimiterOptions(opts []Option) limiterOptions {
+	o := limiterOptions{
+		clock: realClock{},
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if mono, ok := o.clock.(MonotonicClock); ok {
+		o.mono = mono
+		o.epochMono = mono.Monotonic()
+	} else {
+		o.steady = &steadyTime{}
+	}
+	o.epoch = o.clock.Now()
+	return o
+}
+
+//nanotime returns the nanoseconds elapsed since the creation of the limiter,
+//it is measured by the monotonic clock if there is one, so it is not affected by the steps of the wall clock.
+func (o *limiterOptions) nanotime() int64 {
+	if o.mono != nil {
+		return int64(o.mono.Monotonic() - o.epochMono)
+	}
+	//otherwise the readings are serialized, so a reading smaller than the last one means the clock is stepped back,
+	//the elapsed time stands still at that moment rather than going back with the clock.
+	o.steady.mu.Lock()
+	defer o.steady.mu.Unlock()
+	elapsed := o.clock.Now().Sub(o.epoch) + o.steady.offset
+	if elapsed < o.steady.last {
+		o.steady.offset += o.steady.last - elapsed
+		elapsed = o.steady.last
+	}
+	o.steady.last = elapsed
+	return int64(elapsed)
+}
+
+//bucket is the counting algorithm behind a rate limiter or a zone item, it is safe for concurrent use
+type bucket interface {
+	//pour the water of n requests into the bucket, return nil if the bucket has been evicted
+	reserveN(meta *limiterMeta, resolution Resolution, o *limiterOptions, n uint32) *Reservation
+	//give the water of the reservation back to the bucket
+	cancel(r *Reservation)
+	//return the last timestamp in nanoseconds, and whether all the water has leaked out at the nanotime
+	idle(meta *limiterMeta, nanotime int64) (int64, bool)
+	//swap the bucket to the tombstone if it has been idle for the ttl and holds no water
+	evictIdle(meta *limiterMeta, nanotime int64, ttl time.Duration) bool
+	evicted() bool
+}
+
+//newBucket returns an empty bucket of the algorithm, the created time in nanoseconds is kept as its last timestamp
+func (o *limiterOptions) newBucket(created int64) bucket {
+	switch o.algorithm {
+	case AlgorithmEnum.TokenBucket:
+		b := &tokenBucket{}
+		b.reset(created)
+		return b
+	case AlgorithmEnum.GCRA:
+		return &gcraBucket{tat: gcraEmpty, created: created}
+	case AlgorithmEnum.SlidingWindow:
+		return newSlidingWindow(created)
+	case AlgorithmEnum.SlidingLog:
+		return &slidingLog{last: created}
+	case AlgorithmEnum.Quota:
+		return newQuotaBucket(created)
+	}
+	r := &limiterRecord{}
+	r.reset(created)
+	return r
 }
 
 type limiterMeta struct {
 	//configuration variables
-	nodelay    bool
+	nodelay bool
+	//the number of the excess requests passing without delay, the rest up to the burst are delayed
+	delay      uint32
 	burst      uint32
 	rate       uint32
 	resolution Resolution
+	//the period in which the rate is counted, it is the length of the rolling window of the window algorithms
+	window time.Duration
+	//the ceil rate up to which a class of the hierarchical limiter borrows from its parent
+	ceil uint32
+	//the weight of a key in the fair sharing of the zone rate, zero is regarded as 1
+	weight uint32
+	//the zone-wide settings
+	unknownKey UnknownKeyPolicy
+	idleTTL    time.Duration
+	maxEntries int
+	overflow   OverflowPolicy
 }
 
-type limiterRecord struct {
-	//dynamic couting variables
+//limiterConfig holds the configuration as an immutable snapshot,
+//the setters replace the snapshot as a whole, so they never race with the limiting routines
+type limiterConfig struct {
+	//points to a limiterMeta
+	meta unsafe.Pointer
+}
+
+func (c *limiterConfig) loadMeta() *limiterMeta {
+	return (*limiterMeta)(atomic.LoadPointer(&c.meta))
+}
+
+func (c *limiterConfig) storeMeta(meta *limiterMeta) {
+	atomic.StorePointer(&c.meta, unsafe.Pointer(meta))
+}
+
+//updateMeta applies the update to a copy of the current configuration and swaps it in by CAS
+func (c *limiterConfig) updateMeta(update func(meta *limiterMeta)) {
+	for {
+		old := atomic.LoadPointer(&c.meta)
+		meta := *(*limiterMeta)(old)
+		update(&meta)
+		if atomic.CompareAndSwapPointer(&c.meta, old, unsafe.Pointer(&meta)) {
+			return
+		}
+	}
+}
+
+//limiterState is the immutable snapshot of the dynamic counting variables,
+//the last timestamp and the excess always change together by swapping the snapshot
+type limiterState struct {
 	last   int64
 	excess int64
+	//the resolution in which the last timestamp is counted, zero for an empty bucket
+	resolution Resolution
+	//the water of a request in which the excess is counted
+	unit int64
+}
+
+//rescale returns the last timestamp counted in the given resolution, and the excess counted in the given unit.
+//The excess is counted in units of the ticks of the resolution in the period of the rate per request,
+//which do not depend on the rate, so the water level of the bucket is kept when the rate, the period or the resolution changes.
+func (s *limiterState) rescale(resolution Resolution, unit int64) (int64, int64) {
+	last, excess := s.last, s.excess
+	if s.resolution == 0 {
+		return last, excess
+	}
+	if s.resolution != resolution {
+		last = s.last * s.resolution / resolution
+	}
+	if s.unit != unit {
+		excess = scale(s.excess, unit, s.unit)
+	}
+	return last, excess
+}
+
+//unitOf returns the water of a request, which is the ticks of the resolution in the period of the rate,
+//so the water leaks by the rate per tick, and the math stays in integers for the slow rates
+func unitOf(meta *limiterMeta, resolution Resolution) int64 {
+	if unit := windowOf(meta) / resolution; unit > 0 {
+		return unit
+	}
+	return 1
+}
+
+//scale returns v * num / den, the product never overflows, v and num are not negative and den is positive
+func scale(v int64, num int64, den int64) int64 {
+	hi, lo := bits.Mul64(uint64(v), uint64(num))
+	if hi >= uint64(den) {
+		return math.MaxInt64
+	}
+	quo, _ := bits.Div64(hi, lo, uint64(den))
+	if quo > math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return int64(quo)
+}
+
+//maxElapsed returns the max ticks counted for the elapsed time since the last timestamp, it is 1 hour,
+//or long enough for the excess to leak out by the leak per tick, so the leaked water never overflows
+func maxElapsed(excess int64, leak int64, resolution Resolution) int64 {
+	max := int64(time.Hour) / resolution
+	if drain := (excess + leak - 1) / leak; drain > max {
+		return drain
+	}
+	return max
+}
+
+//evictedState is the tombstone of an evicted bucket, a bucket in this state never takes water again
+var evictedState = &limiterState{}
+
+type limiterRecord struct {
+	//dynamic couting variables, points to a limiterState
+	state unsafe.Pointer
+}
+
+//reset empties the bucket, the created time in nanoseconds is kept as the last timestamp of the empty bucket
+func (r *limiterRecord) reset(created int64) {
+	atomic.StorePointer(&r.state, unsafe.Pointer(&limiterState{last: created}))
+}
+
+func (r *limiterRecord) load() *limiterState {
+	return (*limiterState)(atomic.LoadPointer(&r.state))
+}
+
+func (r *limiterRecord) loadExcess(resolution Resolution, unit int64) int64 {
+	_, excess := r.load().rescale(resolution, unit)
+	return excess
+}
+
+func (r *limiterRecord) compareAndSwap(old, new *limiterState) bool {
+	return atomic.CompareAndSwapPointer(&r.state, unsafe.Pointer(old), unsafe.Pointer(new))
+}
+
+func (r *limiterRecord) evicted() bool {
+	return r.load() == evictedState
+}
+
+func (r *limiterRecord) idle(meta *limiterMeta, nanotime int64) (int64, bool) {
+	return r.load().idle(meta, nanotime)
+}
+
+//cancel refunds the reserved water which has not leaked out yet
+func (r *limiterRecord) cancel(reservation *Reservation) {
+	//the reserved water sits on top of the bucket at the time of the reservation,
+	//it leaks out after the water below it, while the water poured later stays on top of it.
+	now := reservation.options.nanotime() / reservation.resolution
+	remaining := reservation.excess - reservation.leak*(now-reservation.last)
+	if remaining > reservation.water {
+		remaining = reservation.water
+	}
+	if remaining <= 0 {
+		return
+	}
+	for {
+		state := r.load()
+		if state == evictedState {
+			return
+		}
+		refund := remaining
+		if state.resolution != 0 && state.unit != reservation.unit {
+			refund = scale(remaining, state.unit, reservation.unit)
+		}
+		excess := state.excess - refund
+		if excess < 0 {
+			excess = 0
+		}
+		if r.compareAndSwap(state, &limiterState{last: state.last, excess: excess, resolution: state.resolution, unit: state.unit}) {
+			return
+		}
+	}
+}
+
+//reserveN pours the water of n requests into the bucket in a single CAS loop,
+//the returned reservation holds the delay time for the whole n requests, or the error if rejected,
+//it returns nil if the bucket has been evicted, then the caller should turn to the new bucket of the key
+func (r *limiterRecord) reserveN(meta *limiterMeta, resolution Resolution, o *limiterOptions, n uint32) *Reservation {
+	var (
+		excess, lastExcess, now, leaked int64
+		state                           *limiterState
+	)
+	resolutionFactor := unitOf(meta, resolution)
+	if meta.rate == 0 {
+		return rejectReservation(meta.burst, resolution, resolutionFactor, r.loadExcess(resolution, resolutionFactor), -1, o)
+	}
+	if n == 0 {
+		return &Reservation{ok: true}
+	}
+	//a batch larger than the bucket can never be accepted,
+	//while a single request is always allowed for a zero burst
+	if n > 1 && n > meta.burst {
+		return rejectReservation(meta.burst, resolution, resolutionFactor, r.loadExcess(resolution, resolutionFactor), -1, o)
+	}
+	rate := int64(meta.rate) * resolutionFactor
+	burst := int64(meta.burst) * resolutionFactor
+	water := int64(n) * resolutionFactor
+
+	for {
+		now = o.nanotime() / resolution
+		state = r.load()
+		if state == evictedState {
+			return nil
+		}
+		var last int64
+		last, lastExcess = state.rescale(resolution, resolutionFactor)
+
+		elapsed := now - last
+		//Note: an empty bucket is regarded as having been idle for long enough,
+		//and here we set a quota for the elapsed with a maximum of 1 hour, or of the time to drain the bucket
+		//along with the water of the first request, which passes free on an empty bucket
+		if max := maxElapsed(lastExcess+resolutionFactor, int64(meta.rate), resolution); state.resolution == 0 || elapsed > max {
+			elapsed = max
+		} else if elapsed < 0 {
+			//the timestamp may fall behind the last one stored by another routine in the meantime
+			elapsed = 0
+			now = last
+		}
+
+		leaked = rate / resolutionFactor * elapsed
+		//the time the bucket is left empty leaks no water of the batch, except for a single request,
+		//so that the first request on an empty bucket passes free as nginx does
+		level := lastExcess - leaked
+		if level < -resolutionFactor {
+			level = -resolutionFactor
+		}
+		excess = level + water
+
+		if excess > burst {
+			//wait until enough water leaks out of the bucket
+			retry := now + (excess-burst+int64(meta.rate)-1)/int64(meta.rate)
+			if level < 0 {
+				level = 0
+			}
+			return rejectReservation(meta.burst, resolution, resolutionFactor, level, retry, o)
+		}
+		if r.compareAndSwap(state, &limiterState{last: now, excess: excess, resolution: resolution, unit: resolutionFactor}) {
+			break
+		}
+	}
+
+	reservation := &Reservation{
+		ok:         true,
+		bucket:     r,
+		options:    o,
+		resolution: resolution,
+		unit:       resolutionFactor,
+		burst:      meta.burst,
+		leak:       rate / resolutionFactor,
+		last:       now,
+		excess:     excess,
+		water:      excess,
+	}
+	//the water below the reserved one which has not leaked yet
+	if lastExcess > leaked {
+		reservation.water -= lastExcess - leaked
+	}
+	//the first excess requests up to the delay setting pass without delay as well
+	if delayed := excess - int64(meta.delay)*resolutionFactor; !meta.nodelay && delayed > 0 {
+		delayInPeriod := float64(delayed) / float64(rate)
+		reservation.delay = int64(delayInPeriod * float64(windowOf(meta)/int64(time.Microsecond)))
+	}
+	return reservation
+}
+
+//idle returns the last timestamp of the bucket in nanoseconds,
+//and whether all its water has leaked out at the nanotime
+func (s *limiterState) idle(meta *limiterMeta, nanotime int64) (int64, bool) {
+	//the last timestamp of an empty bucket is its created time in nanoseconds
+	if s.resolution == 0 {
+		return s.last, true
+	}
+	//the water leaks by the rate per tick in units of the ticks in the period per request
+	elapsed := nanotime/s.resolution - s.last
+	drained := s.excess <= 0 || (meta.rate > 0 && elapsed >= (s.excess+int64(meta.rate)-1)/int64(meta.rate))
+	return s.last * s.resolution, drained
+}
+
+//evictIdle swaps the bucket to the tombstone if it has been idle for the ttl and all its water has leaked out,
+//the nanotime is the current time in nanoseconds, it returns whether the bucket is evicted.
+//A bucket still holding water is never evicted, otherwise it would be refilled by recreating the key.
+func (r *limiterRecord) evictIdle(meta *limiterMeta, nanotime int64, ttl time.Duration) bool {
+	for {
+		state := r.load()
+		if state == evictedState {
+			return false
+		}
+		last, drained := state.idle(meta, nanotime)
+		if !drained || nanotime-last < int64(ttl) {
+			return false
+		}
+		if r.compareAndSwap(state, evictedState) {
+			return true
+		}
+	}
+}
+
+//rejectReservation builds a rejected reservation with the capacity and the water level of the bucket in the unit,
+//and the timestamp in resolution from which a retry could succeed, negative for never
+func rejectReservation(capacity uint32, resolution Resolution, unit int64, level int64, retry int64, o *limiterOptions) *Reservation {
+	err := &RejectedError{
+		Excess: float64(level) / float64(unit),
+		Burst:  capacity,
+	}
+	if retry >= 0 {
+		if after := retry*resolution - o.nanotime(); after > 0 {
+			err.RetryAfter = time.Duration(after)
+		}
+		err.RetryAt = o.clock.Now().Add(err.RetryAfter)
+	}
+	return &Reservation{err: err}
 }
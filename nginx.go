@@ -0,0 +1,374 @@
+package ratelimit
+
+/*
+Copyright (c) Yunpeng Deng(dypflying)
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	//nginxStateSize is the size of a state in the shared memory zone of nginx, one megabyte keeps about 16 thousand states
+	nginxStateSize = 64
+	//nginxIdleTTL is the idle time after which nginx frees the state of a key
+	nginxIdleTTL = time.Minute
+)
+
+//ParseError is the error of a malformed configuration, it tells the line where the error is found
+type ParseError struct {
+	Line int
+	Err  error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+//NginxConflictError is the error of the limit_req directives of a zone in several locations with different settings,
+//which nginx accepts as the settings of each location on the shared state of the zone, while a zone is a single
+//zone rate limiter here. It is wrapped in a *ParseError telling the line of the later directive.
+type NginxConflictError struct {
+	//the name of the zone
+	Zone string
+	//the line of the earlier limit_req directive of the zone
+	Line int
+}
+
+func (e *NginxConflictError) Error() string {
+	return fmt.Sprintf(`conflicting limit_req of zone "%s" with line %d`, e.Zone, e.Line)
+}
+
+//NginxZone is a zone defined by the limit_req_zone directive of nginx, along with the settings of the limit_req
+//directives referring to it
+type NginxZone struct {
+	//the name of the zone
+	Name string
+	//the key of the zone, e.g. $binary_remote_addr, which tells the caller what the requests are keyed by
+	Key string
+	//the size of the zone in bytes
+	Size  int64
+	Rate  Rate
+	Burst uint32
+	//nodelay and delay of the limit_req directive, the later one of them wins
+	Nodelay bool
+	Delay   uint32
+}
+
+//nginxWord is a word of a directive along with its line
+type nginxWord struct {
+	text string
+	line int
+}
+
+//nginxDirective is a simple directive terminated by ";", the block directives are not kept
+type nginxDirective struct {
+	name string
+	args []nginxWord
+	line int
+}
+
+func newParseError(line int, format string, a ...interface{}) error {
+	return &ParseError{Line: line, Err: fmt.Errorf(format, a...)}
+}
+
+//scanNginx splits the nginx configuration into the simple directives, the comments, the quotes and
+//the blocks are handled as nginx does, so the limit_req directives can be picked out of a whole nginx.conf
+func scanNginx(data []byte) ([]nginxDirective, error) {
+	var (
+		directives []nginxDirective
+		words      []nginxWord
+		depth      int
+		line       = 1
+	)
+	for i := 0; i < len(data); {
+		switch c := data[i]; c {
+		case '\n':
+			line++
+			i++
+		case ' ', '\t', '\r':
+			i++
+		case '#':
+			for i < len(data) && data[i] != '\n' {
+				i++
+			}
+		case ';', '{', '}':
+			i++
+			if c == '}' {
+				if len(words) > 0 || depth == 0 {
+					return nil, newParseError(line, `unexpected "}"`)
+				}
+				depth--
+				continue
+			}
+			if len(words) == 0 {
+				return nil, newParseError(line, `unexpected "%c"`, c)
+			}
+			if c == '{' {
+				if strings.HasPrefix(words[0].text, "limit_req") {
+					return nil, newParseError(words[0].line, `directive "%s" is not terminated by ";"`, words[0].text)
+				}
+				depth++
+			} else {
+				directives = append(directives, nginxDirective{name: words[0].text, args: words[1:], line: words[0].line})
+			}
+			words = nil
+		case '"', '\'':
+			start := line
+			var text []byte
+			for i++; i < len(data) && data[i] != c; i++ {
+				if data[i] == '\\' && i+1 < len(data) {
+					i++
+				}
+				if data[i] == '\n' {
+					line++
+				}
+				text = append(text, data[i])
+			}
+			if i == len(data) {
+				return nil, newParseError(start, "unexpected end of file, expecting %c", c)
+			}
+			i++
+			words = append(words, nginxWord{text: string(text), line: start})
+		default:
+			start := i
+			for i < len(data) && !strings.ContainsRune(" \t\r\n;{}", rune(data[i])) {
+				i++
+			}
+			words = append(words, nginxWord{text: string(data[start:i]), line: line})
+		}
+	}
+	if len(words) > 0 {
+		return nil, newParseError(line, `unexpected end of file, expecting ";" or "}"`)
+	}
+	if depth > 0 {
+		return nil, newParseError(line, `unexpected end of file, expecting "}"`)
+	}
+	return directives, nil
+}
+
+//parseNginxSize parses the size of the zone, e.g. 10m, with the optional suffix of k, m or g
+func parseNginxSize(value string) (int64, bool) {
+	shift := 0
+	if n := len(value); n > 0 {
+		switch value[n-1] {
+		case 'k', 'K':
+			shift = 10
+		case 'm', 'M':
+			shift = 20
+		case 'g', 'G':
+			shift = 30
+		}
+		if shift > 0 {
+			value = value[:n-1]
+		}
+	}
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || size <= 0 || size > 1<<(62-shift) {
+		return 0, false
+	}
+	return size << shift, true
+}
+
+//parseNginxRate parses the rate of the zone, e.g. 10r/s or 30r/m
+func parseNginxRate(value string) (Rate, bool) {
+	period := time.Second
+	if strings.HasSuffix(value, "r/m") {
+		period = time.Minute
+	} else if !strings.HasSuffix(value, "r/s") {
+		return Rate{}, false
+	}
+	count, err := strconv.ParseUint(value[:len(value)-3], 10, 32)
+	if err != nil || count == 0 {
+		return Rate{}, false
+	}
+	return Per(uint32(count), period), true
+}
+
+//parseLimitReqZone parses: limit_req_zone key zone=name:size [rate=rate] [sync];
+func parseLimitReqZone(d nginxDirective) (NginxZone, error) {
+	//the rate of nginx is 1r/s if not set
+	zone := NginxZone{Rate: Per(1, time.Second)}
+	if len(d.args) < 2 {
+		return zone, newParseError(d.line, `invalid number of arguments in "%s" directive`, d.name)
+	}
+	zone.Key = d.args[0].text
+	for _, arg := range d.args[1:] {
+		switch value := arg.text; {
+		case strings.HasPrefix(value, "zone="):
+			name, size, found := strings.Cut(value[len("zone="):], ":")
+			if name == "" {
+				return zone, newParseError(arg.line, `invalid zone name "%s"`, value)
+			}
+			var ok bool
+			if zone.Size, ok = parseNginxSize(size); !found || !ok {
+				return zone, newParseError(arg.line, `invalid zone size "%s"`, value)
+			}
+			zone.Name = name
+		case strings.HasPrefix(value, "rate="):
+			var ok bool
+			if zone.Rate, ok = parseNginxRate(value[len("rate="):]); !ok {
+				return zone, newParseError(arg.line, `invalid rate "%s"`, value)
+			}
+		case value == "sync":
+			//the zone synchronization of nginx plus takes no effect here
+		default:
+			return zone, newParseError(arg.line, `invalid parameter "%s"`, value)
+		}
+	}
+	if zone.Name == "" {
+		return zone, newParseError(d.line, `"%s" must have "zone" parameter`, d.name)
+	}
+	return zone, nil
+}
+
+//parseLimitReq parses: limit_req zone=name [burst=number] [nodelay | delay=number];
+//the zone name and the settings are returned in a NginxZone
+func parseLimitReq(d nginxDirective) (NginxZone, error) {
+	var req NginxZone
+	for _, arg := range d.args {
+		switch value := arg.text; {
+		case strings.HasPrefix(value, "zone="):
+			req.Name = value[len("zone="):]
+		case strings.HasPrefix(value, "burst="):
+			//nginx rejects the values which are not positive
+			burst, err := strconv.ParseUint(value[len("burst="):], 10, 32)
+			if err != nil || burst == 0 {
+				return req, newParseError(arg.line, `invalid burst value "%s"`, value)
+			}
+			req.Burst = uint32(burst)
+		case strings.HasPrefix(value, "delay="):
+			delay, err := strconv.ParseUint(value[len("delay="):], 10, 32)
+			if err != nil || delay == 0 {
+				return req, newParseError(arg.line, `invalid delay value "%s"`, value)
+			}
+			req.Delay, req.Nodelay = uint32(delay), false
+		case value == "nodelay":
+			req.Delay, req.Nodelay = 0, true
+		default:
+			return req, newParseError(arg.line, `invalid parameter "%s"`, value)
+		}
+	}
+	if req.Name == "" {
+		return req, newParseError(d.line, `"%s" must have "zone" parameter`, d.name)
+	}
+	return req, nil
+}
+
+//ParseNginx parses the limit_req_zone and limit_req directives of an nginx configuration, the other directives,
+//including limit_req_status, limit_req_log_level and limit_req_dry_run, are skipped. The zones are returned in
+//the order of their limit_req_zone directives, with the burst, nodelay and delay of the limit_req directives
+//referring to them. The limit_req directives of a zone in several locations must have the same settings, since
+//a zone is a single zone rate limiter here, the different settings are reported as *NginxConflictError.
+//The errors are returned as *ParseError telling the line.
+func ParseNginx(r io.Reader) ([]NginxZone, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	directives, err := scanNginx(data)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		zones []NginxZone
+		//the index of the zones and the line of the limit_req directive applied to them by the zone names
+		index   = map[string]int{}
+		applied = map[string]int{}
+		reqs    []nginxDirective
+	)
+	for _, d := range directives {
+		switch d.name {
+		case "limit_req_zone":
+			zone, err := parseLimitReqZone(d)
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := index[zone.Name]; ok {
+				return nil, newParseError(d.line, `duplicate zone "%s"`, zone.Name)
+			}
+			index[zone.Name] = len(zones)
+			zones = append(zones, zone)
+		case "limit_req":
+			//the zone may be defined after the limit_req directives
+			reqs = append(reqs, d)
+		}
+	}
+	for _, d := range reqs {
+		req, err := parseLimitReq(d)
+		if err != nil {
+			return nil, err
+		}
+		i, ok := index[req.Name]
+		if !ok {
+			return nil, newParseError(d.line, `unknown limit_req_zone "%s"`, req.Name)
+		}
+		zone := &zones[i]
+		if line, ok := applied[req.Name]; ok {
+			if zone.Burst != req.Burst || zone.Nodelay != req.Nodelay || zone.Delay != req.Delay {
+				return nil, &ParseError{Line: d.line, Err: &NginxConflictError{Zone: req.Name, Line: line}}
+			}
+			continue
+		}
+		zone.Burst, zone.Nodelay, zone.Delay = req.Burst, req.Nodelay, req.Delay
+		applied[req.Name] = d.line
+	}
+	return zones, nil
+}
+
+//NewNginxZoneLimiter is the contructor for a zone rate limiter of an nginx zone, the keys are created on first use
+//and evicted after they have been idle for a minute as nginx does, while the janitor is left to the caller to start.
+//The zone holds about as many keys as the nginx zone of the same size, the least recently used drained keys are
+//evicted when it is full.
+func NewNginxZoneLimiter(zone NginxZone, opts ...Option) ZoneLimiter {
+	maxEntries := zone.Size / nginxStateSize
+	if maxEntries < 1 {
+		maxEntries = 1
+	}
+	return NewZoneRateLimiterPer(zone.Rate, opts...).
+		SetBurst(zone.Burst).
+		SetNodelay(zone.Nodelay).
+		SetDelay(zone.Delay).
+		SetUnknownKeyPolicy(UnknownKeyPolicyEnum.Create).
+		SetIdleTTL(nginxIdleTTL).
+		SetMaxEntries(int(maxEntries))
+}
+
+//LoadNginx parses the nginx configuration by ParseNginx(), and returns the zone rate limiters by the zone names
+func LoadNginx(r io.Reader, opts ...Option) (map[string]ZoneLimiter, error) {
+	zones, err := ParseNginx(r)
+	if err != nil {
+		return nil, err
+	}
+	limiters := make(map[string]ZoneLimiter, len(zones))
+	for _, zone := range zones {
+		limiters[zone.Name] = NewNginxZoneLimiter(zone, opts...)
+	}
+	return limiters, nil
+}
@@ -0,0 +1,152 @@
+package ratelimit
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+const nginxConf = `
+http {
+    # limit by the client addresses
+    limit_req_zone $binary_remote_addr zone=api:10m rate=10r/s;
+    limit_req_zone $server_name "zone=slow:1m" rate=30r/m;
+    limit_req_zone $binary_remote_addr zone=unused:64k;
+
+    server {
+        location /api/ {
+            limit_req zone=api burst=20 nodelay;
+            limit_req_status 429;
+        }
+        location /api/v2/ {
+            limit_req zone=api burst=20 nodelay;
+        }
+        location /slow/ {
+            limit_req zone=slow burst=12 delay=8;
+        }
+    }
+}
+`
+
+//parse the limit_req directives of a whole nginx.conf, the other directives are skipped
+func TestParseNginx(t *testing.T) {
+	zones, err := ParseNginx(strings.NewReader(nginxConf))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := []NginxZone{
+		{Name: "api", Key: "$binary_remote_addr", Size: 10 << 20, Rate: Per(10, time.Second), Burst: 20, Nodelay: true},
+		{Name: "slow", Key: "$server_name", Size: 1 << 20, Rate: Per(30, time.Minute), Burst: 12, Delay: 8},
+		{Name: "unused", Key: "$binary_remote_addr", Size: 64 << 10, Rate: Per(1, time.Second)},
+	}
+	if len(zones) != len(expected) {
+		t.Fatalf("Expected %d zones, got: %v", len(expected), zones)
+	}
+	for i := range expected {
+		if zones[i] != expected[i] {
+			t.Errorf("Expected zone %v, got: %v", expected[i], zones[i])
+		}
+	}
+}
+
+//the zone rate limiters built from nginx take the settings of the zones, and create the keys on first use
+func TestLoadNginx(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1661990400, 0))
+	limiters, err := LoadNginx(strings.NewReader(nginxConf), WithClock(clock))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(limiters) != 3 {
+		t.Fatalf("Expected 3 zones, got: %d", len(limiters))
+	}
+	//api: 10r/s, burst 20, nodelay, the first request leaks out at once
+	for i := 0; i < 21; i++ {
+		if delay, err := limiters["api"].GetDelayInMicroseconds(defaultKey); err != nil || delay != 0 {
+			t.Fatalf("Request %d of api: unexpected delay %d, %v", i, delay, err)
+		}
+	}
+	if err := limiters["api"].Get(defaultKey); !errors.Is(err, ErrRejected) {
+		t.Errorf("Expected the request beyond the burst of api to be rejected, got: %v", err)
+	}
+	if limiters["api"].Len() != 1 {
+		t.Errorf("Expected the key to be created on first use, got %d keys", limiters["api"].Len())
+	}
+	//slow: 30r/m, burst 12, delay 8, the first 8 excess requests pass without delay
+	for i := 0; i < 9; i++ {
+		if delay, err := limiters["slow"].GetDelayInMicroseconds(defaultKey); err != nil || delay != 0 {
+			t.Fatalf("Request %d of slow: unexpected delay %d, %v", i, delay, err)
+		}
+	}
+	if delay, err := limiters["slow"].GetDelayInMicroseconds(defaultKey); err != nil || delay != 2000000 {
+		t.Errorf("Expected the 9th excess request of slow to be delayed by 2 seconds, got: %d, %v", delay, err)
+	}
+	//unused: 64k holds 1024 keys
+	for i := 0; i < 1025; i++ {
+		limiters["unused"].Get(i)
+	}
+	if limiters["unused"].Len() != 1024 {
+		t.Errorf("Expected the zone to hold 1024 keys, got: %d", limiters["unused"].Len())
+	}
+}
+
+//the malformed configurations are reported with the lines
+func TestParseNginxErrors(t *testing.T) {
+	for _, c := range []struct {
+		conf    string
+		line    int
+		message string
+	}{
+		{"limit_req_zone $a zone=a:1m rate=1r/h;", 1, `invalid rate "rate=1r/h"`},
+		{"limit_req_zone $a zone=a:1m rate=0r/s;", 1, `invalid rate "rate=0r/s"`},
+		{"limit_req_zone $a zone=a rate=1r/s;", 1, `invalid zone size "zone=a"`},
+		{"limit_req_zone $a zone=a:1x;", 1, `invalid zone size "zone=a:1x"`},
+		{"limit_req_zone $a\n  rate=1r/s;", 1, `"limit_req_zone" must have "zone" parameter`},
+		{"limit_req_zone $a zone=a:1m\n  foo;", 2, `invalid parameter "foo"`},
+		{"limit_req_zone zone=a:1m;", 1, `invalid number of arguments in "limit_req_zone" directive`},
+		{"limit_req_zone $a zone=a:1m;\nlimit_req_zone $b zone=a:1m;", 2, `duplicate zone "a"`},
+		{"limit_req_zone $a zone=a:1m;\nlimit_req zone=a burst=-1;", 2, `invalid burst value "burst=-1"`},
+		{"limit_req_zone $a zone=a:1m;\nlimit_req zone=a delay=x;", 2, `invalid delay value "delay=x"`},
+		{"limit_req_zone $a zone=a:1m;\nlimit_req zone=a burst=0;", 2, `invalid burst value "burst=0"`},
+		{"limit_req_zone $a zone=a:1m;\nlimit_req zone=a burst=5 delay=0;", 2, `invalid delay value "delay=0"`},
+		{"limit_req_zone $a zone=a:1m;\nlimit_req burst=1;", 2, `"limit_req" must have "zone" parameter`},
+		{"limit_req_zone $a zone=a:1m;\n\nlimit_req zone=b;", 3, `unknown limit_req_zone "b"`},
+		{"limit_req zone=a burst=1;\nlimit_req zone=a burst=2;\nlimit_req_zone $a zone=a:1m;", 2, `conflicting limit_req of zone "a" with line 1`},
+		{"http {\n  limit_req zone=a\n}", 3, `unexpected "}"`},
+		{"http {\n  limit_req_zone $a zone=a:1m;\n", 3, `unexpected end of file, expecting "}"`},
+		{"limit_req_zone $a zone=a:1m", 1, `unexpected end of file, expecting ";" or "}"`},
+		{"limit_req_zone $a 'zone=a:1m;\n\n", 1, `unexpected end of file, expecting '`},
+		{"}", 1, `unexpected "}"`},
+		{"\n;", 2, `unexpected ";"`},
+		{"limit_req zone=a {\n}", 1, `directive "limit_req" is not terminated by ";"`},
+	} {
+		_, err := LoadNginx(strings.NewReader(c.conf))
+		var parseErr *ParseError
+		if !errors.As(err, &parseErr) || parseErr.Line != c.line || parseErr.Err.Error() != c.message {
+			t.Errorf("%q: expected the error at line %d: %s, got: %v", c.conf, c.line, c.message, err)
+		}
+	}
+}
+
+//the limit_req directives of a zone in two locations with different settings, which nginx accepts
+//it is expected that the conflict is reported as its own error, while the same settings are accepted
+func TestParseNginxConflict(t *testing.T) {
+	conf := `
+limit_req_zone $binary_remote_addr zone=api:10m rate=10r/s;
+server {
+  location /search { limit_req zone=api burst=20 nodelay; }
+  location /login  { limit_req zone=api burst=20 nodelay; }
+  location /upload { limit_req zone=api burst=5; }
+}`
+	_, err := ParseNginx(strings.NewReader(conf))
+	var conflict *NginxConflictError
+	var parseErr *ParseError
+	if !errors.As(err, &conflict) || conflict.Zone != "api" || conflict.Line != 4 ||
+		!errors.As(err, &parseErr) || parseErr.Line != 6 {
+		t.Errorf("Expected the conflict of zone api at line 6 with line 4, got: %v", err)
+	}
+	zones, err := ParseNginx(strings.NewReader(conf[:strings.Index(conf, "  location /upload")] + "}"))
+	if err != nil || len(zones) != 1 || zones[0].Burst != 20 || !zones[0].Nodelay {
+		t.Errorf("Unexpected zones: %+v, %v", zones, err)
+	}
+}
@@ -0,0 +1,408 @@
+package ratelimit
+
+/*
+Copyright (c) Yunpeng Deng(dypflying)
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+import (
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+//QuotaPeriod defines the calendar period of the windows in which a quota limiter counts the requests
+type QuotaPeriod int
+
+type quotaPeriodDefs struct {
+	Minute QuotaPeriod
+	Hour   QuotaPeriod
+	Day    QuotaPeriod
+	Week   QuotaPeriod
+	Month  QuotaPeriod
+}
+
+//QuotaPeriodEnum defines the 5 calendar periods that can be used for the quota limiters
+var QuotaPeriodEnum = &quotaPeriodDefs{
+	Minute: 0,
+	Hour:   1,
+	Day:    2, //the windows start at the midnight
+	Week:   3, //the windows start at the midnight of Monday
+	Month:  4, //the windows start at the midnight of the first day
+}
+
+//QuotaLimiter defines a rate limiter of the quota in the fixed calendar windows,
+//the requests are either accepted without delay or rejected until the quota resets.
+type QuotaLimiter interface {
+	Limiter
+	//return the remaining quota of the current window, and the time when the quota resets
+	Remaining() (uint32, time.Time)
+}
+
+//QuotaZoneLimiter defines a zone rate limiter of the quota in the fixed calendar windows
+type QuotaZoneLimiter interface {
+	ZoneLimiter
+	//return the remaining quota of the key in the current window, and the time when the quota resets,
+	//a full quota is reported for the keys which have not been added, and no reset time for a nil key which is not limited.
+	Remaining(key interface{}) (uint32, time.Time)
+}
+
+type quotaOptions struct {
+	period QuotaPeriod
+	//the windows start at the offset from the calendar boundaries
+	offset   time.Duration
+	location *time.Location
+}
+
+//WithQuotaOffset sets the offset of the windows of a quota limiter from the calendar boundaries,
+//e.g. 8 * time.Hour for the daily quota resetting at 08:00, default is 0
+func WithQuotaOffset(offset time.Duration) Option {
+	return func(o *limiterOptions) {
+		o.quota.offset = offset
+	}
+}
+
+//WithLocation sets the time zone of the calendar windows of a quota limiter, default is UTC
+func WithLocation(location *time.Location) Option {
+	return func(o *limiterOptions) {
+		if location != nil {
+			o.quota.location = location
+		}
+	}
+}
+
+type quotaLimiter struct {
+	*rateLimiter
+}
+
+//NewQuotaLimiter is the contructor for a quota limiter which allows a limit of requests in each calendar period
+func NewQuotaLimiter(limit uint32, period QuotaPeriod, opts ...Option) QuotaLimiter {
+	return &quotaLimiter{NewRateLimiter(limit, quotaOpts(period, opts)...).(*rateLimiter)}
+}
+
+func (q *quotaLimiter) Remaining() (uint32, time.Time) {
+	return q.bucket.(*quotaBucket).remaining(q.loadMeta(), &q.limiterOptions)
+}
+
+//the setters return the quota limiter itself, so that the chained setters keep it a QuotaLimiter
+func (q *quotaLimiter) SetRate(rate uint32) Limiter {
+	if q != nil {
+		q.rateLimiter.SetRate(rate)
+	}
+	return q
+}
+
+func (q *quotaLimiter) SetRatePer(rate Rate) Limiter {
+	if q != nil {
+		q.rateLimiter.SetRatePer(rate)
+	}
+	return q
+}
+
+func (q *quotaLimiter) SetBurst(burst uint32) Limiter {
+	if q != nil {
+		q.rateLimiter.SetBurst(burst)
+	}
+	return q
+}
+
+func (q *quotaLimiter) SetNodelay(nodelay bool) Limiter {
+	if q != nil {
+		q.rateLimiter.SetNodelay(nodelay)
+	}
+	return q
+}
+
+func (q *quotaLimiter) SetDelay(delay uint32) Limiter {
+	if q != nil {
+		q.rateLimiter.SetDelay(delay)
+	}
+	return q
+}
+
+func (q *quotaLimiter) SetResolution(resolution Resolution) Limiter {
+	if q != nil {
+		q.rateLimiter.SetResolution(resolution)
+	}
+	return q
+}
+
+type quotaZoneLimiter struct {
+	*zoneRateLimiter
+}
+
+//NewQuotaZoneLimiter is the contructor for a zone quota limiter which allows a limit of requests for each key in each calendar period
+func NewQuotaZoneLimiter(limit uint32, period QuotaPeriod, opts ...Option) QuotaZoneLimiter {
+	return &quotaZoneLimiter{NewZoneRateLimiter(limit, quotaOpts(period, opts)...).(*zoneRateLimiter)}
+}
+
+func (q *quotaZoneLimiter) Remaining(key interface{}) (uint32, time.Time) {
+	meta := q.loadMeta()
+	if isNilKey(key) {
+		return meta.rate, time.Time{}
+	}
+	if item, ok := q.zoneMap.Load(key); ok {
+		if b, ok := item.bucket.(*quotaBucket); ok {
+			return b.remaining(item.loadMeta(), &q.limiterOptions)
+		}
+	}
+	now := q.nanotime()
+	_, end := q.quota.window(now, q.epoch)
+	return meta.rate, q.clock.Now().Add(time.Duration(end - now))
+}
+
+//the setters return the quota zone limiter itself, so that the chained setters keep it a QuotaZoneLimiter
+func (q *quotaZoneLimiter) SetRate(rate uint32) ZoneLimiter {
+	if q != nil {
+		q.zoneRateLimiter.SetRate(rate)
+	}
+	return q
+}
+
+func (q *quotaZoneLimiter) SetRatePer(rate Rate) ZoneLimiter {
+	if q != nil {
+		q.zoneRateLimiter.SetRatePer(rate)
+	}
+	return q
+}
+
+func (q *quotaZoneLimiter) SetBurst(burst uint32) ZoneLimiter {
+	if q != nil {
+		q.zoneRateLimiter.SetBurst(burst)
+	}
+	return q
+}
+
+func (q *quotaZoneLimiter) SetNodelay(nodelay bool) ZoneLimiter {
+	if q != nil {
+		q.zoneRateLimiter.SetNodelay(nodelay)
+	}
+	return q
+}
+
+func (q *quotaZoneLimiter) SetDelay(delay uint32) ZoneLimiter {
+	if q != nil {
+		q.zoneRateLimiter.SetDelay(delay)
+	}
+	return q
+}
+
+func (q *quotaZoneLimiter) SetResolution(resolution Resolution) ZoneLimiter {
+	if q != nil {
+		q.zoneRateLimiter.SetResolution(resolution)
+	}
+	return q
+}
+
+func (q *quotaZoneLimiter) SetUnknownKeyPolicy(policy UnknownKeyPolicy) ZoneLimiter {
+	if q != nil {
+		q.zoneRateLimiter.SetUnknownKeyPolicy(policy)
+	}
+	return q
+}
+
+func (q *quotaZoneLimiter) SetIdleTTL(ttl time.Duration) ZoneLimiter {
+	if q != nil {
+		q.zoneRateLimiter.SetIdleTTL(ttl)
+	}
+	return q
+}
+
+func (q *quotaZoneLimiter) SetMaxEntries(max int) ZoneLimiter {
+	if q != nil {
+		q.zoneRateLimiter.SetMaxEntries(max)
+	}
+	return q
+}
+
+func (q *quotaZoneLimiter) SetOverflowPolicy(policy OverflowPolicy) ZoneLimiter {
+	if q != nil {
+		q.zoneRateLimiter.SetOverflowPolicy(policy)
+	}
+	return q
+}
+
+func quotaOpts(period QuotaPeriod, opts []Option) []Option {
+	return append(opts, WithAlgorithm(AlgorithmEnum.Quota), func(o *limiterOptions) {
+		o.quota.period = period
+	})
+}
+
+//window returns the start and the end of the calendar window containing the nanotime,
+//the time is measured in nanoseconds since the epoch of the limiter, so the windows are not affected by the steps of the wall clock
+func (q *quotaOptions) window(nanotime int64, epoch time.Time) (int64, int64) {
+	location := q.location
+	if location == nil {
+		location = time.UTC
+	}
+	t := epoch.Add(time.Duration(nanotime)).In(location).Add(-q.offset)
+	year, month, day := t.Date()
+	var start, end time.Time
+	switch q.period {
+	case QuotaPeriodEnum.Minute:
+		start = t.Truncate(time.Minute)
+		end = start.Add(time.Minute)
+	case QuotaPeriodEnum.Hour:
+		start = time.Date(year, month, day, t.Hour(), 0, 0, 0, location)
+		end = start.Add(time.Hour)
+	case QuotaPeriodEnum.Day:
+		start = time.Date(year, month, day, 0, 0, 0, 0, location)
+		end = time.Date(year, month, day+1, 0, 0, 0, 0, location)
+	case QuotaPeriodEnum.Week:
+		day -= (int(t.Weekday()) + 6) % 7
+		start = time.Date(year, month, day, 0, 0, 0, 0, location)
+		end = time.Date(year, month, day+7, 0, 0, 0, 0, location)
+	default:
+		start = time.Date(year, month, 1, 0, 0, 0, 0, location)
+		end = time.Date(year, month+1, 1, 0, 0, 0, 0, location)
+	}
+	return int64(start.Add(q.offset).Sub(epoch)), int64(end.Add(q.offset).Sub(epoch))
+}
+
+//quotaState is the immutable snapshot of the count in the current window
+type quotaState struct {
+	//the end of the current window in nanoseconds, the window is looked up again once it is over
+	end   int64
+	count int64
+	//the time of the last request in nanoseconds
+	last int64
+}
+
+//evictedQuota is the tombstone of an evicted quota bucket
+var evictedQuota = &quotaState{}
+
+//quotaBucket counts the requests in the fixed calendar windows
+type quotaBucket struct {
+	//points to a quotaState
+	state unsafe.Pointer
+}
+
+func newQuotaBucket(created int64) *quotaBucket {
+	return &quotaBucket{state: unsafe.Pointer(&quotaState{last: created})}
+}
+
+func (b *quotaBucket) load() *quotaState {
+	return (*quotaState)(atomic.LoadPointer(&b.state))
+}
+
+func (b *quotaBucket) compareAndSwap(old, new *quotaState) bool {
+	return atomic.CompareAndSwapPointer(&b.state, unsafe.Pointer(old), unsafe.Pointer(new))
+}
+
+//current returns the end of the window and the count in it at the nanotime
+func (s *quotaState) current(o *limiterOptions, nanotime int64) (int64, int64) {
+	if nanotime < s.end {
+		return s.end, s.count
+	}
+	_, end := o.quota.window(nanotime, o.epoch)
+	return end, 0
+}
+
+func (b *quotaBucket) reserveN(meta *limiterMeta, resolution Resolution, o *limiterOptions, n uint32) *Reservation {
+	var (
+		now, end, count int64
+		state           *quotaState
+	)
+	limit := int64(meta.rate)
+	for {
+		now = o.nanotime()
+		state = b.load()
+		if state == evictedQuota {
+			return nil
+		}
+		end, count = state.current(o, now)
+		if int64(n) > limit {
+			return rejectWindow(meta, resolution, float64(count), -1, o)
+		}
+		if n == 0 {
+			return &Reservation{ok: true}
+		}
+		if count+int64(n) > limit {
+			//wait until the quota resets
+			return rejectWindow(meta, resolution, float64(count), end, o)
+		}
+		if b.compareAndSwap(state, &quotaState{end: end, count: count + int64(n), last: now}) {
+			break
+		}
+	}
+	return &Reservation{
+		ok:         true,
+		bucket:     b,
+		options:    o,
+		resolution: resolution,
+		burst:      meta.rate,
+		last:       end,
+		water:      int64(n),
+	}
+}
+
+//cancel gives the requests back to the quota, if the window has not reset
+func (b *quotaBucket) cancel(r *Reservation) {
+	for {
+		state := b.load()
+		if state == evictedQuota || state.end != r.last {
+			return
+		}
+		count := state.count - r.water
+		if count < 0 {
+			count = 0
+		}
+		if b.compareAndSwap(state, &quotaState{end: state.end, count: count, last: state.last}) {
+			return
+		}
+	}
+}
+
+//remaining returns the remaining quota and the time when the quota resets,
+//the reset time is counted from the current time of the clock as the RetryAt of a rejection
+func (b *quotaBucket) remaining(meta *limiterMeta, o *limiterOptions) (uint32, time.Time) {
+	now := o.nanotime()
+	end, count := b.load().current(o, now)
+	remaining := int64(meta.rate) - count
+	if remaining < 0 {
+		remaining = 0
+	}
+	return uint32(remaining), o.clock.Now().Add(time.Duration(end - now))
+}
+
+func (b *quotaBucket) idle(meta *limiterMeta, nanotime int64) (int64, bool) {
+	state := b.load()
+	return state.last, state.count == 0 || nanotime >= state.end
+}
+
+func (b *quotaBucket) evictIdle(meta *limiterMeta, nanotime int64, ttl time.Duration) bool {
+	for {
+		state := b.load()
+		if state == evictedQuota {
+			return false
+		}
+		//the quota used in the current window is kept, otherwise it would be refilled by recreating the key
+		if state.count > 0 && nanotime < state.end || nanotime-state.last < int64(ttl) {
+			return false
+		}
+		if b.compareAndSwap(state, evictedQuota) {
+			return true
+		}
+	}
+}
+
+func (b *quotaBucket) evicted() bool {
+	return b.load() == evictedQuota
+}
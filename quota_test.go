@@ -0,0 +1,122 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+//expectRemaining checks the remaining quota and the time when it resets
+func expectRemaining(t *testing.T, remaining uint32, reset time.Time, expected uint32, expectedReset time.Time) {
+	t.Helper()
+	if remaining != expected || !reset.Equal(expectedReset) {
+		t.Errorf("Expected %d remaining until %v, got %d until %v", expected, expectedReset, remaining, reset)
+	}
+}
+
+//the daily quota of 3 reqs, driven by a fake clock starting an hour before the midnight of UTC
+//it is expected that the 4th req is rejected until the quota resets at the midnight
+func TestQuotaDaily(t *testing.T) {
+	clock := NewFakeClock(time.Date(2022, 9, 1, 23, 0, 0, 0, time.UTC))
+	rl := NewQuotaLimiter(3, QuotaPeriodEnum.Day, WithClock(clock))
+	midnight := time.Date(2022, 9, 2, 0, 0, 0, 0, time.UTC)
+
+	remaining, reset := rl.Remaining()
+	expectRemaining(t, remaining, reset, 3, midnight)
+	for i := 0; i < 3; i++ {
+		if err := rl.Get(); err != nil {
+			t.Fatalf("Request %d is rejected unexpectedly: %v", i, err)
+		}
+	}
+	_, err := rl.GetDelayInMicroseconds()
+	expectRetry(t, err, time.Hour)
+	remaining, reset = rl.Remaining()
+	expectRemaining(t, remaining, reset, 0, midnight)
+
+	//the windows are not affected by the steps of the wall clock, the reset time is counted from the current time
+	clock.Step(-2 * time.Hour)
+	clock.Advance(time.Hour)
+	remaining, reset = rl.Remaining()
+	expectRemaining(t, remaining, reset, 3, midnight.Add(-2*time.Hour).AddDate(0, 0, 1))
+	if err := rl.GetN(3); err != nil {
+		t.Errorf("Unexpected rejection: %v", err)
+	}
+}
+
+//the quotas of the other calendar periods, time zones and offsets, driven by a fake clock at 2022-09-01 (Thursday) 12:00 UTC
+func TestQuotaPeriods(t *testing.T) {
+	now := time.Date(2022, 9, 1, 12, 0, 0, 0, time.UTC)
+	utc8 := time.FixedZone("UTC+8", 8*3600)
+	for _, c := range []struct {
+		period QuotaPeriod
+		opts   []Option
+		reset  time.Time
+	}{
+		{QuotaPeriodEnum.Minute, nil, now.Add(time.Minute)},
+		{QuotaPeriodEnum.Hour, nil, now.Add(time.Hour)},
+		{QuotaPeriodEnum.Week, nil, time.Date(2022, 9, 5, 0, 0, 0, 0, time.UTC)},
+		{QuotaPeriodEnum.Month, nil, time.Date(2022, 10, 1, 0, 0, 0, 0, time.UTC)},
+		//the midnight of UTC+8 is 16:00 UTC
+		{QuotaPeriodEnum.Day, []Option{WithLocation(utc8)}, time.Date(2022, 9, 1, 16, 0, 0, 0, time.UTC)},
+		{QuotaPeriodEnum.Day, []Option{WithLocation(utc8), WithQuotaOffset(8 * time.Hour)}, time.Date(2022, 9, 2, 0, 0, 0, 0, time.UTC)},
+		{QuotaPeriodEnum.Month, []Option{WithQuotaOffset(14 * 24 * time.Hour)}, time.Date(2022, 9, 15, 0, 0, 0, 0, time.UTC)},
+	} {
+		clock := NewFakeClock(now)
+		rl := NewQuotaLimiter(10, c.period, append(c.opts, WithClock(clock))...)
+		rl.GetN(4)
+		remaining, reset := rl.Remaining()
+		expectRemaining(t, remaining, reset, 6, c.reset)
+		clock.Advance(c.reset.Sub(now))
+		remaining, reset = rl.Remaining()
+		if remaining != 10 || !reset.After(c.reset) {
+			t.Errorf("Expected the quota of period %d to reset at %v, got %d until %v", c.period, c.reset, remaining, reset)
+		}
+	}
+}
+
+//the hourly quota of 2 reqs for each key, driven by a fake clock
+func TestQuotaZone(t *testing.T) {
+	clock := NewFakeClock(time.Date(2022, 9, 1, 12, 30, 0, 0, time.UTC))
+	rl := NewQuotaZoneLimiter(2, QuotaPeriodEnum.Hour, WithClock(clock))
+	reset := time.Date(2022, 9, 1, 13, 0, 0, 0, time.UTC)
+	rl.AddZoneItem(defaultKey)
+	rl.SetZoneItem(customizedKey, 5, 0, false)
+
+	remaining, at := rl.Remaining(noExistKey)
+	expectRemaining(t, remaining, at, 2, reset)
+	r := rl.Reserve(defaultKey)
+	rl.Get(defaultKey)
+	_, err := rl.GetDelayInMicroseconds(defaultKey)
+	expectRetry(t, err, 30*time.Minute)
+	r.Cancel()
+	remaining, at = rl.Remaining(defaultKey)
+	expectRemaining(t, remaining, at, 1, reset)
+
+	rl.GetN(customizedKey, 3)
+	remaining, at = rl.Remaining(customizedKey)
+	expectRemaining(t, remaining, at, 2, reset)
+}
+
+//the quota limiters configured by the chained setters, driven by a fake clock
+//it is expected that they are still the quota limiters reporting the remaining quota
+func TestQuotaChainedSetters(t *testing.T) {
+	clock := NewFakeClock(time.Date(2022, 9, 1, 12, 30, 0, 0, time.UTC))
+	reset := time.Date(2022, 9, 2, 0, 0, 0, 0, time.UTC)
+	l, ok := NewQuotaLimiter(2, QuotaPeriodEnum.Day, WithClock(clock)).SetRate(3).SetResolution(ResolutionEnum.Microsecond).(QuotaLimiter)
+	if !ok {
+		t.Fatalf("Expected a QuotaLimiter from the chained setters")
+	}
+	l.Get()
+	remaining, at := l.Remaining()
+	expectRemaining(t, remaining, at, 2, reset)
+
+	rl, ok := NewQuotaZoneLimiter(10, QuotaPeriodEnum.Day, WithClock(clock)).
+		SetUnknownKeyPolicy(UnknownKeyPolicyEnum.Create).SetMaxEntries(100).(QuotaZoneLimiter)
+	if !ok {
+		t.Fatalf("Expected a QuotaZoneLimiter from the chained setters")
+	}
+	if err := rl.GetN(defaultKey, 4); err != nil {
+		t.Fatalf("Unexpected rejection: %v", err)
+	}
+	remaining, at = rl.Remaining(defaultKey)
+	expectRemaining(t, remaining, at, 6, reset)
+}
@@ -0,0 +1,86 @@
+package ratelimit
+
+/*
+Copyright (c) Yunpeng Deng(dypflying)
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+import (
+	"fmt"
+	"time"
+)
+
+//Rate defines the rate of requests as a count of requests per period, e.g. 30 requests per minute,
+//so the rates below 1 request per second are expressed exactly
+type Rate struct {
+	count  uint32
+	period time.Duration
+}
+
+//Per returns the rate of the count of requests per period, a non-positive period is regarded as 1 second
+func Per(count uint32, period time.Duration) Rate {
+	if period <= 0 {
+		period = time.Second
+	}
+	return Rate{count: count, period: period}
+}
+
+//Every returns the rate of 1 request every interval
+func Every(interval time.Duration) Rate {
+	return Per(1, interval)
+}
+
+//Count returns the count of requests in the period
+func (r Rate) Count() uint32 {
+	return r.count
+}
+
+//Period returns the period in which the requests are counted
+func (r Rate) Period() time.Duration {
+	if r.period <= 0 {
+		return time.Second
+	}
+	return r.period
+}
+
+func (r Rate) String() string {
+	return fmt.Sprintf("%d/%v", r.count, r.Period())
+}
+
+//apply sets the rate as the count of requests in the period of the window
+func (r Rate) apply(meta *limiterMeta) {
+	meta.rate = r.count
+	meta.window = r.Period()
+}
+
+//WithRate sets the rate of a key as a count of requests per period, it overrides the rate of SetZoneItem()
+func WithRate(rate Rate) ItemOption {
+	return rate.apply
+}
+
+//NewRateLimiterPer is the contructor for a simple rate limiter with a rate of a count of requests per period
+func NewRateLimiterPer(rate Rate, opts ...Option) Limiter {
+	return NewRateLimiter(rate.count, opts...).SetRatePer(rate)
+}
+
+//NewZoneRateLimiterPer is the contructor for a zone rate limiter with a rate of a count of requests per period
+func NewZoneRateLimiterPer(rate Rate, opts ...Option) ZoneLimiter {
+	return NewZoneRateLimiter(rate.count, opts...).SetRatePer(rate)
+}
@@ -0,0 +1,124 @@
+package ratelimit
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+//rate limit to 1 req every 5 seconds, 30 req/min and 7 req/min, burst is 3, driven by a fake clock
+//the reqs in the bucket are expected to be delayed by the exact intervals for each algorithm of the leaky bucket family
+func TestRatePer(t *testing.T) {
+	for _, rate := range []Rate{Every(5 * time.Second), Per(30, time.Minute), Per(7, time.Minute)} {
+		interval := rate.Period() / time.Duration(rate.Count())
+		for _, algorithm := range []Algorithm{AlgorithmEnum.LeakyBucket, AlgorithmEnum.GCRA} {
+			clock := NewFakeClock(time.Unix(1661990400, 0))
+			rl := NewRateLimiterPer(rate, WithClock(clock), WithAlgorithm(algorithm)).SetBurst(3)
+			//Note: the water of the first request on the empty bucket leaks out at once
+			rl.Get()
+			for i := int64(1); i <= 3; i++ {
+				delay, err := rl.GetDelayInMicroseconds()
+				expected := i * rate.Period().Microseconds() / int64(rate.Count())
+				//Note: the delay of the leaky bucket is truncated from a float, which may fall behind by a microsecond
+				if diff := delay - expected; err != nil || diff < -1 || diff > 0 {
+					t.Errorf("Rate %v, algorithm %d: unexpected delay of request %d: %d, %v", rate, algorithm, i, delay, err)
+				}
+			}
+			//the retry time is rounded up to the resolution
+			var rejected *RejectedError
+			if _, err := rl.GetDelayInMicroseconds(); !errors.As(err, &rejected) ||
+				rejected.RetryAfter < interval || rejected.RetryAfter > interval+time.Millisecond {
+				t.Errorf("Rate %v, algorithm %d: expected rejection with a retry after %v, got: %v", rate, algorithm, interval, err)
+			}
+		}
+	}
+}
+
+//rate limit to 7 req/min with burst 2, and to 1 req every 2 hours or 3 req/day with burst 0, nodelay,
+//1 req every step is offered, driven by a fake clock for days
+//the number of the accepted reqs is expected to be exact without any drift of the slow rate,
+//and the first req is expected to pass, so are the reqs after a long idle time
+func TestRatePerSlow(t *testing.T) {
+	for _, c := range []struct {
+		rate     Rate
+		burst    uint32
+		step     time.Duration
+		days     int
+		expected int
+	}{
+		{Per(7, time.Minute), 2, time.Second, 1, 7 * 24 * 60},
+		{Every(2 * time.Hour), 0, time.Minute, 10, 12 * 10},
+		{Per(3, 24*time.Hour), 0, 10 * time.Minute, 30, 3 * 30},
+	} {
+		for _, algorithm := range []Algorithm{AlgorithmEnum.LeakyBucket, AlgorithmEnum.TokenBucket, AlgorithmEnum.GCRA} {
+			clock := NewFakeClock(time.Unix(1661990400, 0))
+			rl := NewRateLimiterPer(c.rate, WithClock(clock), WithAlgorithm(algorithm)).SetBurst(c.burst).SetNodelay(true).
+				SetResolution(ResolutionEnum.Microsecond)
+			accepted := 0
+			for i := 0; i < c.days*int(24*time.Hour/c.step); i++ {
+				_, err := rl.GetDelayInMicroseconds()
+				if err == nil {
+					accepted++
+				} else if i == 0 {
+					t.Errorf("Rate %v, algorithm %d: the first req is rejected unexpectedly: %v", c.rate, algorithm, err)
+				}
+				clock.Advance(c.step)
+			}
+			if accepted < c.expected || accepted > c.expected+int(c.burst) {
+				t.Errorf("Rate %v, algorithm %d: unexpected number of the accepted reqs: %d, expected: %d", c.rate, algorithm, accepted, c.expected)
+			}
+			clock.Advance(48 * time.Hour)
+			if _, err := rl.GetDelayInMicroseconds(); err != nil {
+				t.Errorf("Rate %v, algorithm %d: the req after 48h idle is rejected unexpectedly: %v", c.rate, algorithm, err)
+			}
+		}
+	}
+	//the first req of a slow rate without nodelay is not delayed, nor is the first req of a new key
+	clock := NewFakeClock(time.Unix(1661990400, 0))
+	rl := NewRateLimiterPer(Every(2*time.Hour), WithClock(clock)).SetBurst(1)
+	if delay, err := rl.GetDelayInMicroseconds(); delay != 0 || err != nil {
+		t.Errorf("Expected no delay for the first req, got: %d, %v", delay, err)
+	}
+	zone := NewZoneRateLimiterPer(Per(1, 24*time.Hour), WithClock(clock)).SetUnknownKeyPolicy(UnknownKeyPolicyEnum.Create)
+	for _, key := range []interface{}{defaultKey, customizedKey} {
+		if delay, err := zone.GetDelayInMicroseconds(key); delay != 0 || err != nil {
+			t.Errorf("Expected no delay for the first req of key %v, got: %d, %v", key, delay, err)
+		}
+	}
+}
+
+//the zone's rate limit to 30 req/min, and the customized key of 1 req every 2 minutes, nodelay, driven by a fake clock
+//the keys are expected to be limited by their periods, and the water level is expected to be kept when the period changes
+func TestZoneRatePer(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1661990400, 0))
+	rl := NewZoneRateLimiterPer(Per(30, time.Minute), WithClock(clock)).SetBurst(1).SetNodelay(true).
+		SetUnknownKeyPolicy(UnknownKeyPolicyEnum.Create)
+	rl.SetZoneItem(customizedKey, 0, 1, true, WithRate(Every(2*time.Minute)))
+
+	for _, c := range []struct {
+		key   interface{}
+		after time.Duration
+	}{{defaultKey, 2 * time.Second}, {customizedKey, 2 * time.Minute}} {
+		//Note: the water of the first request on the empty bucket leaks out at once
+		for i := 0; i < 2; i++ {
+			if _, err := rl.GetDelayInMicroseconds(c.key); err != nil {
+				t.Fatalf("Request %d of key %v is rejected unexpectedly: %v", i, c.key, err)
+			}
+		}
+		var rejected *RejectedError
+		if _, err := rl.GetDelayInMicroseconds(c.key); !errors.As(err, &rejected) || rejected.RetryAfter != c.after ||
+			rejected.Excess != 1 {
+			t.Errorf("Key %v: expected rejection with a retry after %v, got: %v", c.key, c.after, err)
+		}
+	}
+	//the bucket of the default key holds 1 req, which takes 1 minute to leak out at 1 req/min
+	rl.SetZoneItem(defaultKey, 1, 1, true, WithRate(Per(1, time.Minute)))
+	clock.Advance(59 * time.Second)
+	if _, err := rl.GetDelayInMicroseconds(defaultKey); !errors.Is(err, ErrRejected) {
+		t.Errorf("Expected the water level to be kept, got: %v", err)
+	}
+	clock.Advance(time.Second)
+	if _, err := rl.GetDelayInMicroseconds(defaultKey); err != nil {
+		t.Errorf("Unexpected rejection: %v", err)
+	}
+}
@@ -0,0 +1,138 @@
+package ratelimit
+
+/*
+Copyright (c) Yunpeng Deng(dypflying)
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+//Reservation holds the water poured into the bucket by the Reserve() method of a rate limiter,
+//the caller either takes the delay time and goes on, or gives the water back by Cancel().
+type Reservation struct {
+	ok    bool
+	delay int64
+	err   error
+	//the bucket and the water level at the time of the reservation, which are used to refund
+	bucket     bucket
+	options    *limiterOptions
+	resolution Resolution
+	//the water of a request in which the excess is counted, 1e9/resolution if it is not set
+	unit       int64
+	burst      uint32
+	leak       int64
+	last       int64
+	excess     int64
+	water      int64
+	cancelled  int32
+	//the reservations of the child limiters, or of the buckets of the classes of a hierarchical limiter
+	children []*Reservation
+}
+
+//OK returns whether the requests are accepted
+func (r *Reservation) OK() bool {
+	return r.ok
+}
+
+//Delay returns the delay time the caller should wait before taking the action,
+//zero if the reservation is not OK.
+func (r *Reservation) Delay() time.Duration {
+	return time.Duration(r.delay) * time.Microsecond
+}
+
+//excessUnit returns the water of a request in which the excess is counted,
+//the reservations made of the child reservations have neither the unit nor the resolution
+func (r *Reservation) excessUnit() int64 {
+	if r.unit > 0 {
+		return r.unit
+	}
+	if r.resolution > 0 {
+		return 1e9 / r.resolution
+	}
+	return 1
+}
+
+//join attaches the reservation of a child limiter, the delay is the largest one of the children,
+//and the water level is reported from the child of the largest delay
+func (r *Reservation) join(child *Reservation) {
+	r.children = append(r.children, child)
+	if len(r.children) == 1 || child.delay > r.delay {
+		r.delay = child.delay
+		r.burst = child.burst
+		r.excess = child.excess
+		r.unit = child.excessUnit()
+	}
+}
+
+//Cancel gives the reserved water back to the bucket, as if the reservation had never been made.
+//The water that has already leaked out of the bucket by the time of cancelling, i.e. the delay time
+//of the reservation is over, is not refunded. Cancel is idempotent.
+func (r *Reservation) Cancel() {
+	if !r.ok || (r.bucket == nil || r.water <= 0) && len(r.children) == 0 {
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&r.cancelled, 0, 1) {
+		return
+	}
+	for _, child := range r.children {
+		child.Cancel()
+	}
+	if r.bucket != nil && r.water > 0 {
+		r.bucket.cancel(r)
+	}
+}
+
+//waitReservation blocks the caller routine for the delay time of the reservation unless the context is done first,
+//the reservation is cancelled whenever the caller gives up the slot it was assigned.
+func waitReservation(ctx context.Context, clock Clock, r *Reservation) error {
+	if !r.OK() {
+		return r.err
+	}
+	d := r.Delay()
+	if d <= 0 {
+		return nil
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		if remaining := time.Until(deadline); remaining < d {
+			r.Cancel()
+			//the delay time of a retry fits in the same remaining time once the bucket leaks the difference
+			now := clock.Now()
+			return &RejectedError{
+				Excess:     float64(r.excess) / float64(r.excessUnit()),
+				Burst:      r.burst,
+				RetryAt:    now.Add(d - remaining),
+				RetryAfter: d - remaining,
+			}
+		}
+	}
+	timer := clock.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		r.Cancel()
+		return ctx.Err()
+	case <-timer.C():
+		return nil
+	}
+}
@@ -0,0 +1,127 @@
+package ratelimit
+
+/*
+Copyright (c) Yunpeng Deng(dypflying)
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+import "time"
+
+//tokenBucket counts the tokens spent rather than the tokens left, so it shares the state and the refunds with
+//the leaky bucket: the spent tokens are the excess which leaks out at the rate, and the bucket is full of tokens
+//when the excess is zero. Unlike the leaky bucket, the requests are not delayed as long as there are tokens left,
+//so the idle time builds up the burst credit that can be spent instantly.
+//Without nodelay, the requests beyond the tokens are delayed until their tokens are refilled,
+//up to another burst of requests, and the requests beyond are rejected.
+type tokenBucket struct {
+	limiterRecord
+}
+
+//NewTokenBucketLimiter is the contructor for a token bucket rate limiter,
+//the burst is the capacity of the tokens, at least one token is held for a zero burst
+func NewTokenBucketLimiter(rate uint32, opts ...Option) Limiter {
+	return NewRateLimiter(rate, append(opts, WithAlgorithm(AlgorithmEnum.TokenBucket))...)
+}
+
+//NewTokenBucketZoneLimiter is the contructor for a token bucket zone rate limiter
+func NewTokenBucketZoneLimiter(rate uint32, opts ...Option) ZoneLimiter {
+	return NewZoneRateLimiter(rate, append(opts, WithAlgorithm(AlgorithmEnum.TokenBucket))...)
+}
+
+func (b *tokenBucket) reserveN(meta *limiterMeta, resolution Resolution, o *limiterOptions, n uint32) *Reservation {
+	var (
+		excess, spent, now int64
+		state              *limiterState
+	)
+	resolutionFactor := unitOf(meta, resolution)
+	capacity := int64(meta.burst)
+	if capacity == 0 {
+		capacity = 1
+	}
+	//a batch larger than the capacity can never be accepted
+	if meta.rate == 0 || int64(n) > capacity {
+		return rejectReservation(meta.burst, resolution, resolutionFactor, b.loadExcess(resolution, resolutionFactor), -1, o)
+	}
+	if n == 0 {
+		return &Reservation{ok: true}
+	}
+	//the tokens are refilled by the rate per tick in units of the ticks in the period per request
+	rate := int64(meta.rate)
+	capacity *= resolutionFactor
+	limit := capacity
+	if !meta.nodelay {
+		limit += int64(meta.burst) * resolutionFactor
+	}
+	water := int64(n) * resolutionFactor
+
+	for {
+		now = o.nanotime() / resolution
+		state = b.load()
+		if state == evictedState {
+			return nil
+		}
+		var last int64
+		last, spent = state.rescale(resolution, resolutionFactor)
+
+		elapsed := now - last
+		//Note: an empty bucket is regarded as having been idle for long enough
+		if max := maxElapsed(spent, rate, resolution); state.resolution == 0 || elapsed > max {
+			elapsed = max
+		} else if elapsed < 0 {
+			elapsed = 0
+			now = last
+		}
+
+		//the refilled tokens never exceed the capacity
+		spent -= rate * elapsed
+		if spent < 0 {
+			spent = 0
+		}
+		excess = spent + water
+
+		if excess > limit {
+			//wait until enough tokens are refilled
+			retry := now + (excess-limit+rate-1)/rate
+			return rejectReservation(meta.burst, resolution, resolutionFactor, spent, retry, o)
+		}
+		if b.compareAndSwap(state, &limiterState{last: now, excess: excess, resolution: resolution, unit: resolutionFactor}) {
+			break
+		}
+	}
+
+	reservation := &Reservation{
+		ok:         true,
+		bucket:     b,
+		options:    o,
+		resolution: resolution,
+		unit:       resolutionFactor,
+		burst:      meta.burst,
+		leak:       rate,
+		last:       now,
+		excess:     excess,
+		water:      water,
+	}
+	//the requests beyond the tokens wait for the refills
+	if delayed := excess - capacity - int64(meta.delay)*resolutionFactor; delayed > 0 {
+		delayInPeriod := float64(delayed) / float64(rate*resolutionFactor)
+		reservation.delay = int64(delayInPeriod * float64(windowOf(meta)/int64(time.Microsecond)))
+	}
+	return reservation
+}
@@ -0,0 +1,107 @@
+package ratelimit
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+//rate limit to 10 req/s, burst is 5, driven by a fake clock
+//the idle bucket is expected to let 5 reqs through without delay, then delay 5 reqs by the refills, and reject the rest
+func TestTokenBucket(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1661990400, 0))
+	rl := NewTokenBucketLimiter(10, WithClock(clock)).SetBurst(5)
+
+	for round := 0; round < 2; round++ {
+		for i := 0; i < 10; i++ {
+			delay, err := rl.GetDelayInMicroseconds()
+			if err != nil {
+				t.Fatalf("Request %d is rejected unexpectedly: %v", i, err)
+			}
+			if expected := int64(i-4) * 100000; (i < 5 && delay != 0) || (i >= 5 && delay != expected) {
+				t.Errorf("Unexpected delay of request %d: %d", i, delay)
+			}
+		}
+		var rejected *RejectedError
+		if _, err := rl.GetDelayInMicroseconds(); !errors.As(err, &rejected) || rejected.RetryAfter != 100*time.Millisecond {
+			t.Errorf("Expected rejection with a retry after 100ms, got: %v", err)
+		}
+		//the tokens are refilled up to the capacity after the bucket has been idle for 1 second
+		clock.Advance(time.Second)
+	}
+}
+
+//rate limit to 10 req/s, burst is 5, nodelay, driven by a fake clock
+//the reqs beyond the tokens are expected to be rejected, and a cancelled reservation gives its token back
+func TestTokenBucketNodelay(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1661990400, 0))
+	rl := NewTokenBucketLimiter(10, WithClock(clock)).SetBurst(5).SetNodelay(true)
+
+	if err := rl.GetN(4); err != nil {
+		t.Fatalf("Unexpected rejection: %v", err)
+	}
+	r := rl.Reserve()
+	if !r.OK() || r.Delay() != 0 {
+		t.Fatalf("Unexpected reservation: %v, %v", r.OK(), r.Delay())
+	}
+	if _, err := rl.GetDelayInMicroseconds(); !errors.Is(err, ErrRejected) {
+		t.Errorf("Expected rejection, got: %v", err)
+	}
+	r.Cancel()
+	if _, err := rl.GetDelayInMicroseconds(); err != nil {
+		t.Errorf("Expected the token to be given back, got: %v", err)
+	}
+	if _, err := rl.GetDelayInMicrosecondsN(6); !errors.Is(err, ErrRejected) {
+		t.Errorf("Expected rejection of a batch larger than the capacity, got: %v", err)
+	}
+	clock.Advance(100 * time.Millisecond)
+	if _, err := rl.GetDelayInMicroseconds(); err != nil {
+		t.Errorf("Expected a token to be refilled, got: %v", err)
+	}
+	//a single token is held for a zero burst
+	rl.SetBurst(0)
+	clock.Advance(time.Second)
+	if _, err := rl.GetDelayInMicroseconds(); err != nil {
+		t.Errorf("Unexpected rejection: %v", err)
+	}
+	if _, err := rl.GetDelayInMicroseconds(); !errors.Is(err, ErrRejected) {
+		t.Errorf("Expected rejection, got: %v", err)
+	}
+}
+
+//rate limit to 1000 req/s, burst is 100, microsecond resolution, driven by a fake clock
+//64 routines are racing for the buckets of a zone, it is expected that 100 reqs are taken without delay
+//and the next 100 reqs are delayed by the exact rate, run it with -race
+func TestTokenBucketZoneStress(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1661990400, 0))
+	rl := NewTokenBucketZoneLimiter(1000, WithClock(clock)).SetBurst(100).SetResolution(ResolutionEnum.Microsecond).
+		SetUnknownKeyPolicy(UnknownKeyPolicyEnum.Create)
+
+	for _, key := range []interface{}{defaultKey, customizedKey} {
+		delays := stressDelays(func() (int64, error) {
+			return rl.GetDelayInMicroseconds(key)
+		}, 64, 10)
+		checkDelays(t, delays[:100], 100, 0, 0)
+		checkDelays(t, delays[100:], 100, 1000, 1000)
+	}
+}
+
+//rate limit to 10 req/s, burst is 5, delay is 2, driven by a fake clock
+//the idle bucket is expected to let 5 reqs through by the tokens and 2 more without delay, then delay 3 reqs by the refills
+func TestTokenBucketDelayN(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1661990400, 0))
+	rl := NewTokenBucketLimiter(10, WithClock(clock)).SetBurst(5).SetDelay(2)
+
+	for i := 0; i < 10; i++ {
+		delay, err := rl.GetDelayInMicroseconds()
+		if err != nil {
+			t.Fatalf("Request %d is rejected unexpectedly: %v", i, err)
+		}
+		if expected := int64(i-6) * 100000; (i < 7 && delay != 0) || (i >= 7 && delay != expected) {
+			t.Errorf("Unexpected delay of request %d: %d", i, delay)
+		}
+	}
+	if _, err := rl.GetDelayInMicroseconds(); !errors.Is(err, ErrRejected) {
+		t.Errorf("Expected rejection, got: %v", err)
+	}
+}
@@ -0,0 +1,253 @@
+package ratelimit
+
+/*
+Copyright (c) Yunpeng Deng(dypflying)
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+//ConfigWatcher holds the rate limiters and the zone rate limiters built from a config file, and reloads them
+//whenever the file changes. The limiters are updated in place, so the water levels of the limiters and the keys
+//still in the config are kept, while the limiters and the keys removed from the config are dropped.
+type ConfigWatcher struct {
+	path    string
+	opts    []Option
+	clock   Clock
+	onError func(error)
+
+	mu       sync.RWMutex
+	limiters map[string]Limiter
+	zones    map[string]ZoneLimiter
+	//the settings of the last good config
+	limiterSpecs map[string]limiterSpec
+	zoneSpecs    map[string]zoneSpec
+	//the content of the file last read, and the error of the last read
+	data    []byte
+	readErr string
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+//WatchConfigFile builds the rate limiters and the zone rate limiters from the config file, see LoadConfigFile(),
+//and starts a routine polling the file every interval for the changes. The changes are applied as a whole,
+//a config failing to parse or to validate is reported through onError while the last good config is kept,
+//and so are the changes which can not be applied in place, i.e. the algorithm, the quota period, the shards
+//and the fair share mode. The keys created on first use keep the defaults they were created with, the new defaults
+//apply to the keys created afterwards. The options, e.g. WithClock(), apply to all the limiters and the polling.
+func WatchConfigFile(path string, interval time.Duration, onError func(error), opts ...Option) (*ConfigWatcher, error) {
+	w := &ConfigWatcher{
+		path:     path,
+		opts:     opts,
+		clock:    newLimiterOptions(opts).clock,
+		onError:  onError,
+		limiters: map[string]Limiter{},
+		zones:    map[string]ZoneLimiter{},
+	}
+	if err := w.Reload(); err != nil {
+		return nil, err
+	}
+	if interval > 0 {
+		w.stop = make(chan struct{})
+		w.done = make(chan struct{})
+		go w.run(interval)
+	}
+	return w, nil
+}
+
+//Limiter returns the rate limiter of the name, or nil if it is not in the config
+func (w *ConfigWatcher) Limiter(name string) Limiter {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.limiters[name]
+}
+
+//Zone returns the zone rate limiter of the name, or nil if it is not in the config
+func (w *ConfigWatcher) Zone(name string) ZoneLimiter {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.zones[name]
+}
+
+//Reload reads and applies the config file at once, whether it has changed or not,
+//the error is returned rather than reported through onError
+func (w *ConfigWatcher) Reload() error {
+	data, err := os.ReadFile(w.path)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.data, w.readErr = data, ""
+	return w.apply(data)
+}
+
+//Close stops the polling routine and the janitors of the zone rate limiters,
+//the limiters are still usable afterwards
+func (w *ConfigWatcher) Close() error {
+	w.closeOnce.Do(func() {
+		if w.stop != nil {
+			close(w.stop)
+			<-w.done
+		}
+	})
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	for _, zone := range w.zones {
+		zone.Close()
+	}
+	return nil
+}
+
+func (w *ConfigWatcher) run(interval time.Duration) {
+	defer close(w.done)
+	for {
+		timer := w.clock.NewTimer(interval)
+		select {
+		case <-w.stop:
+			timer.Stop()
+			return
+		case <-timer.C():
+			if err := w.poll(); err != nil && w.onError != nil {
+				w.onError(err)
+			}
+		}
+	}
+}
+
+//poll applies the config file if its content has changed, each error is reported once until the file changes again
+func (w *ConfigWatcher) poll() error {
+	data, err := os.ReadFile(w.path)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err != nil {
+		//e.g. the file is being replaced, report it once
+		if err.Error() == w.readErr {
+			return nil
+		}
+		w.readErr = err.Error()
+		return err
+	}
+	if w.readErr == "" && bytes.Equal(data, w.data) {
+		return nil
+	}
+	w.data, w.readErr = data, ""
+	return w.apply(data)
+}
+
+//apply parses the config and applies it to the limiters, nothing is changed if it fails
+func (w *ConfigWatcher) apply(data []byte) error {
+	config, err := parseConfigFile(w.path, data)
+	if err != nil {
+		return err
+	}
+	limiterSpecs, zoneSpecs, err := config.specs()
+	if err != nil {
+		return err
+	}
+	if err := w.check(limiterSpecs, zoneSpecs); err != nil {
+		return err
+	}
+	for name := range w.limiters {
+		if _, ok := limiterSpecs[name]; !ok {
+			delete(w.limiters, name)
+		}
+	}
+	for name, s := range limiterSpecs {
+		if l, ok := w.limiters[name]; ok {
+			s.apply(l)
+		} else {
+			w.limiters[name] = s.newLimiter(w.opts)
+		}
+	}
+	for name, z := range w.zones {
+		if _, ok := zoneSpecs[name]; !ok {
+			z.Close()
+			delete(w.zones, name)
+		}
+	}
+	for name, s := range zoneSpecs {
+		z, ok := w.zones[name]
+		if !ok {
+			w.zones[name] = s.newZoneLimiter(w.opts)
+			continue
+		}
+		old := w.zoneSpecs[name]
+		s.apply(z)
+		for key := range old.keys {
+			if _, ok := s.keys[key]; !ok {
+				z.DeleteZoneItem(key)
+			}
+		}
+		for key, k := range s.keys {
+			if o, ok := old.keys[key]; !ok || o != k {
+				k.apply(z, key)
+			}
+		}
+		if s.janitorInterval != old.janitorInterval {
+			z.StopJanitor()
+			z.StartJanitor(s.janitorInterval)
+		}
+	}
+	w.limiterSpecs, w.zoneSpecs = limiterSpecs, zoneSpecs
+	return nil
+}
+
+//check returns the errors of the changes which can not be applied to the limiters in place
+func (w *ConfigWatcher) check(limiterSpecs map[string]limiterSpec, zoneSpecs map[string]zoneSpec) error {
+	var errs configErrors
+	for _, name := range sortedNames(limiterSpecs) {
+		if old, ok := w.limiterSpecs[name]; ok {
+			s := limiterSpecs[name]
+			checkReload(&errs, fmt.Sprintf("limiters[%s]", name), &old, &s)
+		}
+	}
+	for _, name := range sortedNames(zoneSpecs) {
+		if old, ok := w.zoneSpecs[name]; ok {
+			s := zoneSpecs[name]
+			path := fmt.Sprintf("zones[%s]", name)
+			checkReload(&errs, path, &old.limiterSpec, &s.limiterSpec)
+			if s.shards != old.shards {
+				errs.add(path+".shards", "can not be changed by reload")
+			}
+			if s.fair != old.fair {
+				errs.add(path+".fair_share", "can not be changed by reload")
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func checkReload(errs *configErrors, path string, old *limiterSpec, s *limiterSpec) {
+	if s.algorithm != old.algorithm {
+		errs.add(path+".algorithm", "can not be changed by reload")
+	} else if s.quota != old.quota {
+		errs.add(path+".period", "can not be changed by reload")
+	}
+}
@@ -0,0 +1,158 @@
+package ratelimit
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const watchedConfig = `{
+  "limiters": {"login": {"rate": 10, "burst": 5}},
+  "zones": {
+    "api": {
+      "rate": 10, "burst": 5, "unknown_key_policy": "deny",
+      "keys": {"a": {}, "b": {"burst": 10}}
+    }
+  }
+}`
+
+func writeConfig(t *testing.T, path string, config string) {
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expectDelay(t *testing.T, name string, getDelay func() (int64, error), expected int64) {
+	if delay, err := getDelay(); err != nil || delay != expected {
+		t.Errorf("%s: expected the delay of %d, got: %d, %v", name, expected, delay, err)
+	}
+}
+
+//the reloaded config updates the limiters in place, the water levels of the keys still in the config are kept,
+//and the keys removed from the config are dropped
+func TestConfigWatcherReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "limits.json")
+	writeConfig(t, path, watchedConfig)
+	clock := NewFakeClock(time.Unix(1661990400, 0))
+	w, err := WatchConfigFile(path, 0, nil, WithClock(clock))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer w.Close()
+	api, login := w.Zone("api"), w.Limiter("login")
+	//the first request leaks out at once, the bucket of a holds 3 requests afterwards, as well as login
+	for i := 0; i < 4; i++ {
+		api.GetDelayInMicroseconds("a")
+		login.GetDelayInMicroseconds()
+	}
+	writeConfig(t, path, `{
+  "limiters": {"login": {"rate": 10, "burst": 5, "nodelay": true}},
+  "zones": {
+    "api": {
+      "rate": 10, "burst": 5, "unknown_key_policy": "deny",
+      "keys": {"a": {"burst": 20}, "c": {}}
+    },
+    "web": {"rate": 10}
+  }
+}`)
+	if err := w.Reload(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if w.Zone("api") != api || w.Limiter("login") != login || w.Zone("web") == nil {
+		t.Fatalf("Expected the limiters to be updated in place and the new ones to be added")
+	}
+	expectDelay(t, "a", func() (int64, error) { return api.GetDelayInMicroseconds("a") }, 400000)
+	expectDelay(t, "login", login.GetDelayInMicroseconds, 0)
+	if err := api.Get("b"); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Expected b to be removed, got: %v", err)
+	}
+	expectDelay(t, "c", func() (int64, error) { return api.GetDelayInMicroseconds("c") }, 0)
+	//the zones removed from the config are dropped
+	writeConfig(t, path, `{"zones": {"api": {"rate": 10, "burst": 5, "unknown_key_policy": "deny", "keys": {"a": {"burst": 20}}}}}`)
+	if err := w.Reload(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if w.Zone("web") != nil || w.Limiter("login") != nil || api.Len() != 1 {
+		t.Errorf("Expected the removed limiters and keys to be dropped")
+	}
+	expectDelay(t, "a", func() (int64, error) { return api.GetDelayInMicroseconds("a") }, 500000)
+}
+
+//a config failing to parse, to validate or to be applied in place is rejected as a whole, the last good one is kept
+func TestConfigWatcherErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "limits.json")
+	writeConfig(t, path, watchedConfig)
+	clock := NewFakeClock(time.Unix(1661990400, 0))
+	w, err := WatchConfigFile(path, 0, nil, WithClock(clock))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer w.Close()
+	for _, c := range []struct {
+		config  string
+		message string
+	}{
+		{`{"zones": {"api": {"rate": 10,}}}`, "invalid character"},
+		{`{"zones": {"api": {"rate": 10, "burst": 1, "keys": {"a": {"period": "1x"}}}}}`, `zones[api].keys[a].period: invalid duration "1x"`},
+		{`{"zones": {"api": {"rate": 10, "algorithm": "gcra"}}}`, "zones[api].algorithm: can not be changed by reload"},
+		{`{"zones": {"api": {"rate": 10, "shards": 16}}, "limiters": {"login": {"rate": 10, "algorithm": "quota", "period": "day"}}}`,
+			"limiters[login].algorithm: can not be changed by reload\ninvalid config: zones[api].shards: can not be changed by reload"},
+	} {
+		writeConfig(t, path, c.config)
+		if err := w.Reload(); err == nil || !strings.Contains(err.Error(), c.message) {
+			t.Errorf("%s: expected the error of %s, got: %v", c.config, c.message, err)
+		}
+		if w.Zone("api").Len() != 2 || w.Limiter("login") == nil {
+			t.Errorf("%s: expected the last good config to be kept", c.config)
+		}
+	}
+	writeConfig(t, path, `{"zones": {"api": {"burst": 10}}}`)
+	if _, err := WatchConfigFile(path, 0, nil); err == nil {
+		t.Errorf("Expected the error of the initial config")
+	}
+}
+
+//the file is polled for the changes, and each error is reported once until the file changes again
+func TestConfigWatcherPolling(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "limits.json")
+	writeConfig(t, path, watchedConfig)
+	clock := NewFakeClock(time.Unix(1661990400, 0))
+	errs := make(chan error, 10)
+	w, err := WatchConfigFile(path, time.Second, func(err error) { errs <- err }, WithClock(clock))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer w.Close()
+	//advance the clock until the condition is met, the polling routine sets up its timer in the meantime
+	poll := func(done func() bool) bool {
+		for i := 0; i < 100; i++ {
+			clock.Advance(time.Second)
+			time.Sleep(10 * time.Millisecond)
+			if done() {
+				return true
+			}
+		}
+		return false
+	}
+	writeConfig(t, path, `{"zones": {"api": {"rate": 10, "burst": -1}}}`)
+	if !poll(func() bool { return len(errs) > 0 }) {
+		t.Fatalf("Expected the error to be reported")
+	}
+	poll(func() bool { return false })
+	if len(errs) != 1 {
+		t.Errorf("Expected the error to be reported once, got %d errors", len(errs))
+	}
+	writeConfig(t, path, strings.Replace(watchedConfig, `"b"`, `"c"`, 1))
+	if !poll(func() bool {
+		_, err := w.Zone("api").GetDelayInMicroseconds("c")
+		return err == nil
+	}) {
+		t.Errorf("Expected the change to be applied")
+	}
+	if err := w.Zone("api").Get("b"); !errors.Is(err, ErrUnknownKey) || len(errs) != 1 {
+		t.Errorf("Expected b to be removed without errors, got: %v, %d errors", err, len(errs))
+	}
+}
@@ -0,0 +1,359 @@
+package ratelimit
+
+/*
+Copyright (c) Yunpeng Deng(dypflying)
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+//The window algorithms limit the number of requests in a rolling window, the rate is the limit in the window.
+//The requests are either accepted without delay or rejected, so the burst and the nodelay settings do not apply,
+//and the rejection tells when the window frees up for the requests.
+
+//NewSlidingWindowLimiter is the contructor for a rate limiter of the sliding window counter,
+//which allows a limit of requests in a rolling window
+func NewSlidingWindowLimiter(limit uint32, window time.Duration, opts ...Option) Limiter {
+	r := NewRateLimiter(limit, append(opts, WithAlgorithm(AlgorithmEnum.SlidingWindow))...).(*rateLimiter)
+	r.updateMeta(func(meta *limiterMeta) {
+		meta.window = window
+	})
+	return r
+}
+
+//NewSlidingWindowZoneLimiter is the contructor for a zone rate limiter of the sliding window counter
+func NewSlidingWindowZoneLimiter(limit uint32, window time.Duration, opts ...Option) ZoneLimiter {
+	z := NewZoneRateLimiter(limit, append(opts, WithAlgorithm(AlgorithmEnum.SlidingWindow))...).(*zoneRateLimiter)
+	z.updateMeta(func(meta *limiterMeta) {
+		meta.window = window
+	})
+	return z
+}
+
+//NewSlidingLogLimiter is the contructor for a rate limiter of the sliding log,
+//which allows a limit of requests in a rolling window
+func NewSlidingLogLimiter(limit uint32, window time.Duration, opts ...Option) Limiter {
+	r := NewRateLimiter(limit, append(opts, WithAlgorithm(AlgorithmEnum.SlidingLog))...).(*rateLimiter)
+	r.updateMeta(func(meta *limiterMeta) {
+		meta.window = window
+	})
+	return r
+}
+
+//NewSlidingLogZoneLimiter is the contructor for a zone rate limiter of the sliding log
+func NewSlidingLogZoneLimiter(limit uint32, window time.Duration, opts ...Option) ZoneLimiter {
+	z := NewZoneRateLimiter(limit, append(opts, WithAlgorithm(AlgorithmEnum.SlidingLog))...).(*zoneRateLimiter)
+	z.updateMeta(func(meta *limiterMeta) {
+		meta.window = window
+	})
+	return z
+}
+
+//windowOf returns the length of the window in nanoseconds, which is the period of the rate, default is 1 second
+func windowOf(meta *limiterMeta) int64 {
+	if meta.window <= 0 {
+		return int64(time.Second)
+	}
+	return int64(meta.window)
+}
+
+//rejectWindow builds a rejected reservation with the count of requests in the window,
+//and the time in nanoseconds from which a retry could succeed, negative for never
+func rejectWindow(meta *limiterMeta, resolution Resolution, count float64, retry int64, o *limiterOptions) *Reservation {
+	if retry >= 0 {
+		retry = (retry + resolution - 1) / resolution
+	}
+	return rejectReservation(meta.rate, resolution, 1e9/resolution, int64(count*float64(1e9/resolution)), retry, o)
+}
+
+//windowState is the immutable snapshot of the counters of a sliding window
+type windowState struct {
+	//the start of the current fixed window in nanoseconds, aligned to the multiples of the window length
+	start int64
+	//the number of requests in the previous and the current fixed windows
+	prev int64
+	cur  int64
+	//the time of the last request in nanoseconds
+	last int64
+}
+
+//evictedWindow is the tombstone of an evicted sliding window
+var evictedWindow = &windowState{}
+
+//slidingWindow approximates the number of requests in the rolling window by the counters of two fixed windows,
+//the previous one is weighted by its overlap with the rolling window, assuming its requests were evenly distributed.
+type slidingWindow struct {
+	//points to a windowState
+	state unsafe.Pointer
+}
+
+func newSlidingWindow(created int64) *slidingWindow {
+	return &slidingWindow{state: unsafe.Pointer(&windowState{last: created})}
+}
+
+func (w *slidingWindow) load() *windowState {
+	return (*windowState)(atomic.LoadPointer(&w.state))
+}
+
+func (w *slidingWindow) compareAndSwap(old, new *windowState) bool {
+	return atomic.CompareAndSwapPointer(&w.state, unsafe.Pointer(old), unsafe.Pointer(new))
+}
+
+//roll returns the counters of the previous and the current fixed windows for the window starting at start
+func (s *windowState) roll(start int64, window int64) (int64, int64) {
+	switch s.start {
+	case start:
+		return s.prev, s.cur
+	case start - window:
+		return s.cur, 0
+	}
+	return 0, 0
+}
+
+func (w *slidingWindow) reserveN(meta *limiterMeta, resolution Resolution, o *limiterOptions, n uint32) *Reservation {
+	var (
+		now, start int64
+		state      *windowState
+	)
+	window := windowOf(meta)
+	limit := int64(meta.rate)
+	if int64(n) > limit {
+		now = o.nanotime()
+		prev, cur := w.load().roll(now-now%window, window)
+		return rejectWindow(meta, resolution, float64(prev+cur), -1, o)
+	}
+	if n == 0 {
+		return &Reservation{ok: true}
+	}
+
+	for {
+		now = o.nanotime() / resolution * resolution
+		state = w.load()
+		if state == evictedWindow {
+			return nil
+		}
+		start = now - now%window
+		prev, cur := state.roll(start, window)
+		weight := float64(window-(now-start)) / float64(window)
+		count := float64(prev)*weight + float64(cur)
+
+		if count+float64(n) > float64(limit) {
+			//the weight of the previous window goes down as time goes by,
+			//otherwise wait for the next window in which the current one is weighted
+			var retry int64
+			if cur+int64(n) <= limit {
+				retry = start + int64(math.Ceil(float64(window)*(1-float64(limit-cur-int64(n))/float64(prev))))
+			} else {
+				retry = start + window + int64(math.Ceil(float64(window)*(1-float64(limit-int64(n))/float64(cur))))
+			}
+			return rejectWindow(meta, resolution, count, retry, o)
+		}
+		if w.compareAndSwap(state, &windowState{start: start, prev: prev, cur: cur + int64(n), last: now}) {
+			break
+		}
+	}
+	//the reservation keeps the start of the fixed window and the start of the next one
+	return &Reservation{
+		ok:         true,
+		bucket:     w,
+		options:    o,
+		resolution: resolution,
+		burst:      meta.rate,
+		last:       start,
+		excess:     start + window,
+		water:      int64(n),
+	}
+}
+
+//cancel takes the requests out of the fixed window they were counted in, if it is still counted
+func (w *slidingWindow) cancel(r *Reservation) {
+	for {
+		state := w.load()
+		if state == evictedWindow {
+			return
+		}
+		next := *state
+		switch state.start {
+		case r.last:
+			next.cur -= r.water
+		case r.excess:
+			next.prev -= r.water
+		default:
+			return
+		}
+		if next.cur < 0 {
+			next.cur = 0
+		}
+		if next.prev < 0 {
+			next.prev = 0
+		}
+		if w.compareAndSwap(state, &next) {
+			return
+		}
+	}
+}
+
+func (w *slidingWindow) idle(meta *limiterMeta, nanotime int64) (int64, bool) {
+	return w.load().idle(windowOf(meta), nanotime)
+}
+
+//idle returns the time of the last request, and whether none of the fixed windows counts a request at the nanotime
+func (s *windowState) idle(window int64, nanotime int64) (int64, bool) {
+	prev, cur := s.roll(nanotime-nanotime%window, window)
+	return s.last, prev == 0 && cur == 0
+}
+
+func (w *slidingWindow) evictIdle(meta *limiterMeta, nanotime int64, ttl time.Duration) bool {
+	for {
+		state := w.load()
+		if state == evictedWindow {
+			return false
+		}
+		last, drained := state.idle(windowOf(meta), nanotime)
+		if !drained || nanotime-last < int64(ttl) {
+			return false
+		}
+		if w.compareAndSwap(state, evictedWindow) {
+			return true
+		}
+	}
+}
+
+func (w *slidingWindow) evicted() bool {
+	return w.load() == evictedWindow
+}
+
+//logEntry is the time of a batch of accepted requests
+type logEntry struct {
+	at int64
+	n  int64
+}
+
+//slidingLog counts the requests in the rolling window exactly by logging the time of each batch of requests,
+//it takes the memory of the limit of entries at most, and the log is guarded by a mutex.
+type slidingLog struct {
+	mu sync.Mutex
+	//the batches in the rolling window, the oldest first
+	entries []logEntry
+	//the number of requests in the entries
+	count int64
+	//the time of the last request, or the created time of an empty log
+	last       int64
+	tombstoned bool
+}
+
+//expire drops the entries out of the rolling window ending at now
+func (l *slidingLog) expire(now int64, window int64) {
+	i := 0
+	for ; i < len(l.entries) && l.entries[i].at <= now-window; i++ {
+		l.count -= l.entries[i].n
+	}
+	l.entries = l.entries[i:]
+}
+
+func (l *slidingLog) reserveN(meta *limiterMeta, resolution Resolution, o *limiterOptions, n uint32) *Reservation {
+	window := windowOf(meta)
+	limit := int64(meta.rate)
+	now := o.nanotime() / resolution * resolution
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.tombstoned {
+		return nil
+	}
+	l.expire(now, window)
+	if int64(n) > limit {
+		return rejectWindow(meta, resolution, float64(l.count), -1, o)
+	}
+	if n == 0 {
+		return &Reservation{ok: true}
+	}
+	if excess := l.count + int64(n) - limit; excess > 0 {
+		//wait until enough requests expire from the window
+		var retry int64
+		for _, entry := range l.entries {
+			if excess -= entry.n; excess <= 0 {
+				retry = entry.at + window
+				break
+			}
+		}
+		return rejectWindow(meta, resolution, float64(l.count), retry, o)
+	}
+	l.entries = append(l.entries, logEntry{at: now, n: int64(n)})
+	l.count += int64(n)
+	l.last = now
+	return &Reservation{
+		ok:         true,
+		bucket:     l,
+		options:    o,
+		resolution: resolution,
+		burst:      meta.rate,
+		last:       now,
+		water:      int64(n),
+	}
+}
+
+//cancel removes the requests from the entry of the reservation, if it is still in the window
+func (l *slidingLog) cancel(r *Reservation) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i := len(l.entries) - 1; i >= 0 && l.entries[i].at >= r.last; i-- {
+		if entry := &l.entries[i]; entry.at == r.last && entry.n >= r.water {
+			entry.n -= r.water
+			l.count -= r.water
+			if entry.n == 0 {
+				l.entries = append(l.entries[:i], l.entries[i+1:]...)
+			}
+			return
+		}
+	}
+}
+
+func (l *slidingLog) idle(meta *limiterMeta, nanotime int64) (int64, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.expire(nanotime, windowOf(meta))
+	return l.last, l.count == 0
+}
+
+func (l *slidingLog) evictIdle(meta *limiterMeta, nanotime int64, ttl time.Duration) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.tombstoned {
+		return false
+	}
+	l.expire(nanotime, windowOf(meta))
+	if l.count > 0 || nanotime-l.last < int64(ttl) {
+		return false
+	}
+	l.tombstoned = true
+	return true
+}
+
+func (l *slidingLog) evicted() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.tombstoned
+}
@@ -0,0 +1,104 @@
+package ratelimit
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+//expectRetry checks that the request is rejected with the retry after time
+func expectRetry(t *testing.T, err error, retryAfter time.Duration) {
+	t.Helper()
+	var rejected *RejectedError
+	if !errors.As(err, &rejected) || rejected.RetryAfter != retryAfter {
+		t.Errorf("Expected rejection with a retry after %v, got: %v", retryAfter, err)
+	}
+}
+
+//limit to 10 reqs per rolling minute by the sliding window counter, driven by a fake clock
+//the reqs of the previous minute are expected to be weighted by its overlap with the rolling window
+func TestSlidingWindow(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1661990400, 0))
+	rl := NewSlidingWindowLimiter(10, time.Minute, WithClock(clock))
+
+	for i := 0; i < 10; i++ {
+		if err := rl.Get(); err != nil {
+			t.Fatalf("Request %d is rejected unexpectedly: %v", i, err)
+		}
+	}
+	//the next minute counts 10 * (1 - 6/60) = 9 reqs after 6 seconds
+	_, err := rl.GetDelayInMicroseconds()
+	expectRetry(t, err, 66*time.Second)
+	clock.Advance(66 * time.Second)
+	r := rl.Reserve()
+	if !r.OK() || r.Delay() != 0 {
+		t.Fatalf("Unexpected reservation: %v, %v", r.OK(), r.Delay())
+	}
+	_, err = rl.GetDelayInMicroseconds()
+	expectRetry(t, err, 6*time.Second)
+	//the cancelled request is no longer counted
+	r.Cancel()
+	if err := rl.Get(); err != nil {
+		t.Errorf("Unexpected rejection: %v", err)
+	}
+	if _, err := rl.GetDelayInMicrosecondsN(11); !errors.Is(err, ErrRejected) {
+		t.Errorf("Expected rejection of a batch larger than the limit, got: %v", err)
+	}
+}
+
+//limit to 3 reqs per rolling second by the sliding log, driven by a fake clock
+//it is expected that a req is accepted once the oldest one is out of the rolling window
+func TestSlidingLog(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1661990400, 0))
+	rl := NewSlidingLogLimiter(3, time.Second, WithClock(clock))
+
+	for i := 0; i < 3; i++ {
+		if err := rl.Get(); err != nil {
+			t.Fatalf("Request %d is rejected unexpectedly: %v", i, err)
+		}
+		clock.Advance(300 * time.Millisecond)
+	}
+	_, err := rl.GetDelayInMicroseconds()
+	expectRetry(t, err, 100*time.Millisecond)
+	clock.Advance(100 * time.Millisecond)
+	r := rl.Reserve()
+	if !r.OK() {
+		t.Fatalf("Unexpected rejection: %v", r.err)
+	}
+	clock.Advance(100 * time.Millisecond)
+	_, err = rl.GetDelayInMicroseconds()
+	expectRetry(t, err, 200*time.Millisecond)
+	r.Cancel()
+	r.Cancel()
+	if _, err := rl.GetDelayInMicroseconds(); err != nil {
+		t.Errorf("Unexpected rejection: %v", err)
+	}
+	if _, err := rl.GetDelayInMicroseconds(); !errors.Is(err, ErrRejected) {
+		t.Errorf("Expected rejection, got: %v", err)
+	}
+}
+
+//limit each key to 100 reqs per rolling second by the window algorithms, driven by a fake clock
+//64 routines are racing for the keys, it is expected that exactly 100 reqs are accepted, run it with -race
+func TestWindowZoneStress(t *testing.T) {
+	for _, algorithm := range []Algorithm{AlgorithmEnum.SlidingWindow, AlgorithmEnum.SlidingLog} {
+		clock := NewFakeClock(time.Unix(1661990400, 0))
+		rl := NewZoneRateLimiter(100, WithClock(clock), WithAlgorithm(algorithm)).
+			SetUnknownKeyPolicy(UnknownKeyPolicyEnum.Create).SetIdleTTL(time.Second)
+		for _, key := range []interface{}{defaultKey, customizedKey} {
+			checkDelays(t, stressDelays(func() (int64, error) {
+				return rl.GetDelayInMicroseconds(key)
+			}, 64, 10), 100, 0, 0)
+		}
+		//the keys are evicted once no request is counted in the window
+		z := rl.(*zoneRateLimiter)
+		clock.Advance(time.Second)
+		if n := z.evictIdle(); algorithm == AlgorithmEnum.SlidingLog && n != 2 || algorithm == AlgorithmEnum.SlidingWindow && n != 0 {
+			t.Errorf("Unexpected eviction of %v: %d", algorithm, n)
+		}
+		clock.Advance(time.Second)
+		if z.evictIdle(); rl.Len() != 0 {
+			t.Errorf("Expected the keys to be evicted, got %d", rl.Len())
+		}
+	}
+}
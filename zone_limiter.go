@@ -23,173 +23,629 @@ SOFTWARE.
 */
 
 import (
+	"context"
 	"errors"
+	"math/rand"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
 type zoneItem struct {
-	limiterMeta
-	limiterRecord
+	//the weight counted in the fair share while the key is active, zero if it is inactive, -1 once it is removed
+	active int64
+	//1 if the item is listed for the sweep of the fair share
+	listed int32
+	//1 if the item takes the default settings of the zone, either created on first use or added by AddZoneItem(),
+	//only such items are evicted with UnknownKeyPolicyEnum.Create, which creates them again on their next requests,
+	//while the keys customized explicitly are kept until they are deleted
+	defaults int32
+	//the index of the item in the LRU candidates plus 1, 0 if it is not a candidate, guarded by the lock of the candidates
+	slot int
+	limiterConfig
+	bucket
 }
 
+type zoneRateLimiterOf[K comparable] struct {
+	limiterConfig
+	limiterOptions
+	zoneMap zoneStore[K]
+	//the number of the keys in the zone map
+	entries int64
+	//the bucket shared among the new keys of a full zone, it follows the zone settings
+	overflow zoneItem
+	//the active keys sharing the zone rate in the fair share mode
+	fair fairShare
+	//the janitor routine evicting the idle items, it is running while stop is not nil
+	janitor struct {
+		mu   sync.Mutex
+		stop chan struct{}
+		done chan struct{}
+	}
+	//the items of the default settings, which are sampled for the least recently used one when the zone is full,
+	//it is updated only when the items are created or removed, so the requests never take the lock
+	lru struct {
+		mu    sync.Mutex
+		items []lruCandidate[K]
+	}
+}
+
+type lruCandidate[K comparable] struct {
+	key  K
+	item *zoneItem
+}
+
+const (
+	//the number of the LRU candidates sampled for an eviction, all of them are visited if there are no more
+	lruSamples = 8
+	//the number of the attempts of an eviction, the sampled item may take water or be removed in the meantime
+	lruAttempts = 3
+)
+
+//zoneRateLimiter is the zone rate limiter of interface{} keys, a thin wrapper over the generic one
 type zoneRateLimiter struct {
-	limiterMeta
-	zoneMap sync.Map
+	*zoneRateLimiterOf[interface{}]
 }
 
 //NewZoneRateLimiter is the contructor for a zone rate limiter
-func NewZoneRateLimiter(rate uint32) ZoneLimiter {
-	z := &zoneRateLimiter{}
-	z.resolution = ResolutionEnum.Millisecond
-	z.rate = rate
+func NewZoneRateLimiter(rate uint32, opts ...Option) ZoneLimiter {
+	return &zoneRateLimiter{newZoneRateLimiterOf[interface{}](rate, opts)}
+}
+
+//NewZoneRateLimiterOf is the contructor for a zone rate limiter of the keys of type K
+func NewZoneRateLimiterOf[K comparable](rate uint32, opts ...Option) ZoneLimiterOf[K] {
+	return newZoneRateLimiterOf[K](rate, opts)
+}
+
+func newZoneRateLimiterOf[K comparable](rate uint32, opts []Option) *zoneRateLimiterOf[K] {
+	z := &zoneRateLimiterOf[K]{}
+	z.limiterOptions = newLimiterOptions(opts)
+	z.zoneMap = newZoneStore[K](z.shards)
+	z.storeMeta(&limiterMeta{
+		rate:       rate,
+		resolution: ResolutionEnum.Millisecond,
+	})
+	z.overflow.bucket = z.newBucket(0)
+	if z.limiterOptions.fair {
+		z.fair.bucket = z.newBucket(0)
+	}
+	return z
+}
+
+func (z *zoneRateLimiterOf[K]) SetRate(rate uint32) ZoneLimiterOf[K] {
+	if z != nil {
+		z.updateMeta(func(meta *limiterMeta) {
+			meta.rate = rate
+		})
+	}
+	return z
+}
+
+func (z *zoneRateLimiterOf[K]) SetRatePer(rate Rate) ZoneLimiterOf[K] {
+	if z != nil {
+		z.updateMeta(rate.apply)
+	}
+	return z
+}
+
+func (z *zoneRateLimiterOf[K]) SetBurst(burst uint32) ZoneLimiterOf[K] {
+	if z != nil {
+		z.updateMeta(func(meta *limiterMeta) {
+			meta.burst = burst
+		})
+	}
+	return z
+}
+
+func (z *zoneRateLimiterOf[K]) SetNodelay(nodelay bool) ZoneLimiterOf[K] {
+	if z != nil {
+		z.updateMeta(func(meta *limiterMeta) {
+			meta.nodelay = nodelay
+		})
+	}
+	return z
+}
+
+func (z *zoneRateLimiterOf[K]) SetDelay(delay uint32) ZoneLimiterOf[K] {
+	if z != nil {
+		z.updateMeta(func(meta *limiterMeta) {
+			meta.delay = delay
+		})
+	}
+	return z
+}
+
+func (z *zoneRateLimiterOf[K]) SetResolution(resolution Resolution) ZoneLimiterOf[K] {
+	if z != nil {
+		z.updateMeta(func(meta *limiterMeta) {
+			meta.resolution = resolution
+		})
+	}
 	return z
 }
 
 func (z *zoneRateLimiter) SetRate(rate uint32) ZoneLimiter {
 	if z != nil {
-		z.rate = rate
+		z.zoneRateLimiterOf.SetRate(rate)
+	}
+	return z
+}
+
+//SetRatePer sets the default rate as a count of requests per period, the new keys take the period as well
+func (z *zoneRateLimiter) SetRatePer(rate Rate) ZoneLimiter {
+	if z != nil {
+		z.zoneRateLimiterOf.SetRatePer(rate)
 	}
 	return z
 }
 
 func (z *zoneRateLimiter) SetBurst(burst uint32) ZoneLimiter {
 	if z != nil {
-		z.burst = burst
+		z.zoneRateLimiterOf.SetBurst(burst)
 	}
 	return z
 }
 
 func (z *zoneRateLimiter) SetNodelay(nodelay bool) ZoneLimiter {
 	if z != nil {
-		z.nodelay = nodelay
+		z.zoneRateLimiterOf.SetNodelay(nodelay)
+	}
+	return z
+}
+
+//SetDelay sets the number of the excess requests passing without delay, overwritable by a specific key configuration
+func (z *zoneRateLimiter) SetDelay(delay uint32) ZoneLimiter {
+	if z != nil {
+		z.zoneRateLimiterOf.SetDelay(delay)
 	}
 	return z
 }
 
 func (z *zoneRateLimiter) SetResolution(resolution Resolution) ZoneLimiter {
 	if z != nil {
-		z.resolution = resolution
+		z.zoneRateLimiterOf.SetResolution(resolution)
+	}
+	return z
+}
+
+//SetUnknownKeyPolicy sets how the keys which have never been added are treated, default is allowing them without limit
+func (z *zoneRateLimiter) SetUnknownKeyPolicy(policy UnknownKeyPolicy) ZoneLimiter {
+	if z != nil {
+		z.zoneRateLimiterOf.SetUnknownKeyPolicy(policy)
+	}
+	return z
+}
+
+func (z *zoneRateLimiterOf[K]) SetUnknownKeyPolicy(policy UnknownKeyPolicy) ZoneLimiterOf[K] {
+	if z != nil {
+		z.updateMeta(func(meta *limiterMeta) {
+			meta.unknownKey = policy
+		})
+	}
+	return z
+}
+
+//SetIdleTTL sets the idle time after which the drained items of the default settings are evicted by the janitor
+//with UnknownKeyPolicyEnum.Create, zero disables the eviction
+func (z *zoneRateLimiter) SetIdleTTL(ttl time.Duration) ZoneLimiter {
+	if z != nil {
+		z.zoneRateLimiterOf.SetIdleTTL(ttl)
 	}
 	return z
 }
 
-func (z *zoneRateLimiter) AddZoneItem(key interface{}) error {
-	if z != nil && key != nil {
-		if _, ok := z.zoneMap.Load(key); ok {
+func (z *zoneRateLimiterOf[K]) SetIdleTTL(ttl time.Duration) ZoneLimiterOf[K] {
+	if z != nil {
+		z.updateMeta(func(meta *limiterMeta) {
+			meta.idleTTL = ttl
+		})
+	}
+	return z
+}
+
+//SetMaxEntries sets the max number of the keys held by the zone, zero means no limit
+func (z *zoneRateLimiter) SetMaxEntries(max int) ZoneLimiter {
+	if z != nil {
+		z.zoneRateLimiterOf.SetMaxEntries(max)
+	}
+	return z
+}
+
+func (z *zoneRateLimiterOf[K]) SetMaxEntries(max int) ZoneLimiterOf[K] {
+	if z != nil {
+		z.updateMeta(func(meta *limiterMeta) {
+			meta.maxEntries = max
+		})
+	}
+	return z
+}
+
+//SetOverflowPolicy sets how the new keys are treated when the zone holds the max entries, default is evicting the LRU key
+func (z *zoneRateLimiter) SetOverflowPolicy(policy OverflowPolicy) ZoneLimiter {
+	if z != nil {
+		z.zoneRateLimiterOf.SetOverflowPolicy(policy)
+	}
+	return z
+}
+
+func (z *zoneRateLimiterOf[K]) SetOverflowPolicy(policy OverflowPolicy) ZoneLimiterOf[K] {
+	if z != nil {
+		z.updateMeta(func(meta *limiterMeta) {
+			meta.overflow = policy
+		})
+	}
+	return z
+}
+
+//Len returns the number of the keys held by the zone
+func (z *zoneRateLimiterOf[K]) Len() int {
+	if z == nil {
+		return 0
+	}
+	return int(atomic.LoadInt64(&z.entries))
+}
+
+//StartJanitor starts a routine which evicts the idle items every interval, it does nothing if the janitor is running
+func (z *zoneRateLimiterOf[K]) StartJanitor(interval time.Duration) {
+	if z == nil || interval <= 0 {
+		return
+	}
+	z.janitor.mu.Lock()
+	defer z.janitor.mu.Unlock()
+	if z.janitor.stop != nil {
+		return
+	}
+	z.janitor.stop = make(chan struct{})
+	z.janitor.done = make(chan struct{})
+	go z.runJanitor(interval, z.janitor.stop, z.janitor.done)
+}
+
+//StopJanitor stops the janitor routine and waits for it to exit
+func (z *zoneRateLimiterOf[K]) StopJanitor() {
+	if z == nil {
+		return
+	}
+	z.janitor.mu.Lock()
+	defer z.janitor.mu.Unlock()
+	if z.janitor.stop == nil {
+		return
+	}
+	close(z.janitor.stop)
+	<-z.janitor.done
+	z.janitor.stop, z.janitor.done = nil, nil
+}
+
+//Close stops the janitor routine, the zone rate limiter is still usable afterwards
+func (z *zoneRateLimiterOf[K]) Close() error {
+	z.StopJanitor()
+	return nil
+}
+
+func (z *zoneRateLimiterOf[K]) runJanitor(interval time.Duration, stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	for {
+		timer := z.clock.NewTimer(interval)
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C():
+			z.evictIdle()
+		}
+	}
+}
+
+//evictIdle removes the items which have been idle for the ttl and hold no water, return the number of the evicted items
+func (z *zoneRateLimiterOf[K]) evictIdle() int {
+	zoneMeta := z.loadMeta()
+	ttl := zoneMeta.idleTTL
+	if ttl <= 0 {
+		return 0
+	}
+	evicted := 0
+	now := z.nanotime()
+	z.zoneMap.Range(func(key K, item *zoneItem) bool {
+		//the item is swapped to the tombstone before it is removed,
+		//so the routines holding it turn to a new item rather than pouring water into the removed one
+		if item.evictable(zoneMeta) && item.evictIdle(z.itemMeta(item, zoneMeta, false), now, ttl) {
+			z.removeItem(key, item)
+			evicted++
+		}
+		return true
+	})
+	return evicted
+}
+
+//evictLRU evicts the least recently used item of the default settings which holds no water,
+//return false if there is no such item. The LRU item is approximated by the least recently used one of the sampled items,
+//so an eviction takes a constant time however many items the zone holds.
+func (z *zoneRateLimiterOf[K]) evictLRU() bool {
+	now := z.nanotime()
+	zoneMeta := z.loadMeta()
+	for attempt := 0; attempt < lruAttempts; attempt++ {
+		lru, ok := z.sampleLRU(zoneMeta, now)
+		if !ok {
+			return false
+		}
+		//the item may have been evicted by another routine, then remove it anyway,
+		//or it may have taken water or been customized in the meantime, then look for another one
+		if lru.item.evictable(zoneMeta) && lru.item.evictIdle(z.itemMeta(lru.item, zoneMeta, false), now, 0) || lru.item.evicted() {
+			z.removeItem(lru.key, lru.item)
+			return true
+		}
+	}
+	return false
+}
+
+//sampleLRU returns the least recently used item holding no water among the sampled LRU candidates
+func (z *zoneRateLimiterOf[K]) sampleLRU(zoneMeta *limiterMeta, now int64) (lruCandidate[K], bool) {
+	var (
+		lru     lruCandidate[K]
+		lruLast int64
+		found   bool
+	)
+	z.lru.mu.Lock()
+	defer z.lru.mu.Unlock()
+	candidates := z.lru.items
+	for i := 0; i < lruSamples && i < len(candidates); i++ {
+		c := candidates[i]
+		if len(candidates) > lruSamples {
+			c = candidates[rand.Intn(len(candidates))]
+		}
+		if !c.item.evictable(zoneMeta) {
+			continue
+		}
+		if last, drained := c.item.idle(z.itemMeta(c.item, zoneMeta, false), now); drained && (!found || last < lruLast) {
+			lru, lruLast, found = c, last, true
+		}
+	}
+	return lru, found
+}
+
+//track adds the item of the default settings to the LRU candidates, unless it has been removed or customized in the meantime,
+//which untracks the item after changing it
+func (z *zoneRateLimiterOf[K]) track(key K, item *zoneItem) {
+	z.lru.mu.Lock()
+	defer z.lru.mu.Unlock()
+	if actual, ok := z.zoneMap.Load(key); ok && actual == item && item.slot == 0 && atomic.LoadInt32(&item.defaults) == 1 {
+		z.lru.items = append(z.lru.items, lruCandidate[K]{key, item})
+		item.slot = len(z.lru.items)
+	}
+}
+
+//untrack removes the item from the LRU candidates, by moving the last candidate to its place
+func (z *zoneRateLimiterOf[K]) untrack(item *zoneItem) {
+	z.lru.mu.Lock()
+	defer z.lru.mu.Unlock()
+	if i := item.slot - 1; i >= 0 {
+		last := len(z.lru.items) - 1
+		z.lru.items[i] = z.lru.items[last]
+		z.lru.items[i].item.slot = i + 1
+		z.lru.items[last] = lruCandidate[K]{}
+		z.lru.items = z.lru.items[:last]
+		item.slot = 0
+	}
+}
+
+//evictable tells whether the item takes the default settings of the zone, which is created again on its next request
+//once it is evicted, so it can be evicted only with UnknownKeyPolicyEnum.Create
+func (item *zoneItem) evictable(zoneMeta *limiterMeta) bool {
+	return zoneMeta.unknownKey == UnknownKeyPolicyEnum.Create && atomic.LoadInt32(&item.defaults) == 1
+}
+
+//storeItem adds the item of the key within the max entries, or returns the existing item of the key,
+//the error is returned if the zone is full
+func (z *zoneRateLimiterOf[K]) storeItem(key K, item *zoneItem, meta *limiterMeta) (*zoneItem, bool, error) {
+	if actual, ok := z.zoneMap.Load(key); ok {
+		return actual, true, nil
+	}
+	//the entry is taken before storing the item, so the concurrent new keys never exceed the max entries
+	for atomic.AddInt64(&z.entries, 1) > int64(meta.maxEntries) && meta.maxEntries > 0 {
+		atomic.AddInt64(&z.entries, -1)
+		if meta.overflow != OverflowPolicyEnum.EvictLRU || !z.evictLRU() {
+			return nil, false, ErrZoneFull
+		}
+	}
+	actual, loaded := z.zoneMap.LoadOrStore(key, item)
+	if loaded {
+		atomic.AddInt64(&z.entries, -1)
+	} else if atomic.LoadInt32(&item.defaults) == 1 {
+		z.track(key, item)
+	}
+	return actual, loaded, nil
+}
+
+//removeItem removes the item of the key if it is still in the zone map
+func (z *zoneRateLimiterOf[K]) removeItem(key K, item *zoneItem) {
+	if z.zoneMap.CompareAndDelete(key, item) {
+		atomic.AddInt64(&z.entries, -1)
+	}
+	z.untrack(item)
+	z.retire(item)
+}
+
+func (z *zoneRateLimiterOf[K]) AddZoneItem(key K) error {
+	if z != nil && !isNilKey(key) {
+		meta := z.loadMeta()
+		item := z.newZoneItem(meta.rate, meta.burst, meta.nodelay)
+		item.defaults = 1
+		if _, loaded, err := z.storeItem(key, item, meta); err != nil {
+			return err
+		} else if loaded {
 			return errors.New("key exists")
 		}
-		item := &zoneItem{}
-		item.nodelay = z.nodelay
-		item.rate = z.rate
-		item.burst = z.burst
-		atomic.StoreInt64(&item.excess, 0)
-		atomic.StoreInt64(&item.last, 0)
-		z.zoneMap.Store(key, item)
 	}
 	return nil
 }
 
-func (z *zoneRateLimiter) DeleteZoneItem(key interface{}) error {
-	if z != nil && key != nil {
-		if _, ok := z.zoneMap.Load(key); !ok {
+func (z *zoneRateLimiterOf[K]) DeleteZoneItem(key K) error {
+	if z != nil && !isNilKey(key) {
+		item, ok := z.zoneMap.LoadAndDelete(key)
+		if !ok {
 			return errors.New("key not exists")
 		}
-		z.zoneMap.Delete(key)
+		atomic.AddInt64(&z.entries, -1)
+		z.untrack(item)
+		z.retire(item)
 	}
 	return nil
 }
 
-func (z *zoneRateLimiter) SetZoneItem(key interface{}, rate uint32, burst uint32, nodelay bool) {
-	if z != nil && key != nil {
-		if v, ok := z.zoneMap.Load(key); ok {
-			item := v.(*limiterMeta)
-			item.burst = burst
-			item.rate = rate
-			item.nodelay = nodelay
-		} else {
-			item := &zoneItem{}
-			item.nodelay = nodelay
-			item.rate = rate
-			item.burst = burst
-			atomic.StoreInt64(&item.excess, 0)
-			atomic.StoreInt64(&item.last, 0)
-			z.zoneMap.Store(key, item)
+//SetZoneItem replaces the settings of an existing key and keeps its water level, or adds the key with the settings,
+//the customized keys are not limited by the max entries
+func (z *zoneRateLimiterOf[K]) SetZoneItem(key K, rate uint32, burst uint32, nodelay bool, opts ...ItemOption) {
+	if z == nil || isNilKey(key) {
+		return
+	}
+	for {
+		item, loaded := z.zoneMap.LoadOrStore(key, z.newZoneItem(rate, burst, nodelay, opts...))
+		if !loaded {
+			atomic.AddInt64(&z.entries, 1)
+			return
 		}
+		//the key customized explicitly is no longer evicted
+		atomic.StoreInt32(&item.defaults, 0)
+		z.untrack(item)
+		item.updateMeta(func(meta *limiterMeta) {
+			meta.burst = burst
+			meta.rate = rate
+			meta.nodelay = nodelay
+			for _, opt := range opts {
+				opt(meta)
+			}
+		})
+		if !item.evicted() {
+			return
+		}
+		//the item has been evicted in the meantime, remove it and add a new one
+		z.removeItem(key, item)
+	}
+}
+
+//isNilKey tells whether the key is a nil interface, which is not limited
+func isNilKey[K comparable](key K) bool {
+	return any(key) == nil
+}
+
+func (z *zoneRateLimiterOf[K]) newZoneItem(rate uint32, burst uint32, nodelay bool, opts ...ItemOption) *zoneItem {
+	item := &zoneItem{}
+	zoneMeta := z.loadMeta()
+	meta := &limiterMeta{
+		nodelay: nodelay,
+		delay:   zoneMeta.delay,
+		rate:    rate,
+		burst:   burst,
+		window:  zoneMeta.window,
 	}
+	for _, opt := range opts {
+		opt(meta)
+	}
+	item.storeMeta(meta)
+	//the idle time of a new item is counted from its creation
+	item.bucket = z.newBucket(z.nanotime())
+	return item
+}
+
+func (z *zoneRateLimiterOf[K]) Get(key K) error {
+	return z.GetN(key, 1)
 }
 
-func (z *zoneRateLimiter) Get(key interface{}) error {
+func (z *zoneRateLimiterOf[K]) GetN(key K, n uint32) error {
 
-	delay, err := z.GetDelayInMicroseconds(key)
+	delay, err := z.GetDelayInMicrosecondsN(key, n)
 	if err != nil {
 		return err
 	} else if delay > 0 {
-		time.Sleep(time.Duration(delay) * time.Microsecond)
+		z.clock.Sleep(time.Duration(delay) * time.Microsecond)
 	}
 	return nil
 }
 
-//return:
-//	#1. the delay time in microseconds
-//	#2. error if rejected
-func (z *zoneRateLimiter) GetDelayInMicroseconds(key interface{}) (int64, error) {
+func (z *zoneRateLimiterOf[K]) GetContext(ctx context.Context, key K) error {
 
-	if key == nil {
-		//do nothing
-		return 0, nil
+	if err := ctx.Err(); err != nil {
+		return err
 	}
+	return waitReservation(ctx, z.clock, z.Reserve(key))
+}
 
-	var (
-		excess, lastExcess int64
-		item               *zoneItem
-	)
+func (z *zoneRateLimiterOf[K]) Reserve(key K) *Reservation {
+	return z.ReserveN(key, 1)
+}
 
-	if v, ok := z.zoneMap.Load(key); ok {
-		item = v.(*zoneItem)
-	} else {
-		return 0, nil
-	}
+func (z *zoneRateLimiterOf[K]) ReserveN(key K, n uint32) *Reservation {
 
-	if item.rate <= 0 {
-		return 0, errorReject
+	if isNilKey(key) {
+		//do nothing
+		return &Reservation{ok: true}
 	}
-
-	resolutionFactor := 1e9 / z.resolution
-	rate := int64(item.rate) * resolutionFactor
-	burst := int64(item.burst) * resolutionFactor
-
 	for {
-		//note: after golang 1.17, it introduced UnixMilli() and UnixMicro() functions,
-		//but to support the golang before 1.17, we still use UnixNano to retrieve the timestamps.
-		now := time.Now().UnixNano() / z.resolution
-
-		elapsed := now - item.last
-		//Note: the elapsed value may be huge since it is retrieved from the nanoseconds from 1970.1.1 for the first call of the object
-		//here we set a quota for the elapsed with a maximum of 1 hour
-		if elapsed > int64(time.Hour)/z.resolution {
-			elapsed = int64(time.Hour) / z.resolution
+		item, err := z.loadItem(key)
+		if err != nil {
+			return &Reservation{err: err}
+		} else if item == nil {
+			return &Reservation{ok: true}
 		}
-
-		lastExcess = atomic.LoadInt64(&item.excess)
-		excess = lastExcess - rate/resolutionFactor*elapsed + resolutionFactor
-
-		if excess < 0 {
-			excess = 0
+		zoneMeta := z.loadMeta()
+		if z.limiterOptions.fair {
+			if reservation := z.reserveFair(item, zoneMeta, n); reservation != nil {
+				return reservation
+			}
+			z.removeItem(key, item)
+			continue
 		}
-
-		if excess > burst {
-			return 0, errorReject
+		meta := item.loadMeta()
+		if item == &z.overflow {
+			meta = zoneMeta
 		}
-		if atomic.CompareAndSwapInt64(&item.excess, lastExcess, excess) {
-			item.last = now
-			break
+		if reservation := item.reserveN(meta, zoneMeta.resolution, &z.limiterOptions, n); reservation != nil {
+			return reservation
 		}
+		//the item has been evicted in the meantime, remove it and retry as a key never added
+		z.removeItem(key, item)
 	}
-	if !item.nodelay {
-		delayInSecond := float64(excess) / float64(rate)
-		return int64(delayInSecond * 1e6), nil
+}
+
+//return:
+//	#1. the delay time in microseconds
+//	#2. error if rejected
+func (z *zoneRateLimiterOf[K]) GetDelayInMicroseconds(key K) (int64, error) {
+	return z.GetDelayInMicrosecondsN(key, 1)
+}
+
+//return:
+//	#1. the delay time in microseconds for the whole n requests
+//	#2. error if rejected
+func (z *zoneRateLimiterOf[K]) GetDelayInMicrosecondsN(key K, n uint32) (int64, error) {
+
+	reservation := z.ReserveN(key, n)
+	if !reservation.ok {
+		return 0, reservation.err
+	}
+	return reservation.delay, nil
+}
+
+//loadItem returns the item of the key, or nil if the key is not limited,
+//or the error if the key is rejected according to the unknown key policy or the overflow policy
+func (z *zoneRateLimiterOf[K]) loadItem(key K) (*zoneItem, error) {
+	if item, ok := z.zoneMap.Load(key); ok {
+		return item, nil
+	}
+	meta := z.loadMeta()
+	switch meta.unknownKey {
+	case UnknownKeyPolicyEnum.Deny:
+		return nil, errUnknownKeyRejected
+	case UnknownKeyPolicyEnum.Create:
+		//the concurrent first requests of the key share the same bucket
+		created := z.newZoneItem(meta.rate, meta.burst, meta.nodelay)
+		created.defaults = 1
+		item, _, err := z.storeItem(key, created, meta)
+		if err == nil {
+			return item, nil
+		} else if meta.overflow == OverflowPolicyEnum.Shared {
+			return &z.overflow, nil
+		}
+		return nil, errZoneFullRejected
 	}
-	return 0, nil
+	return nil, nil
 }
@@ -1,11 +1,16 @@
 package ratelimit
 
 import (
+	"context"
 	"errors"
+	"hash/maphash"
+	"math"
+	"reflect"
 	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
+	"unsafe"
 )
 
 var (
@@ -145,3 +150,684 @@ func TestCustomerized(t *testing.T) {
 		t.Errorf("Finished unexpectedly: %v", err)
 	}
 }
+
+//the zone's rate limit to 10 req/s, burst is 10, the second request of the key is delayed by 100 milliseconds
+//it is expected that the request wakes up as soon as the context is canceled and gives back the water not leaked yet
+func TestZoneGetContext(t *testing.T) {
+	t.Parallel()
+	rl := NewZoneRateLimiter(10).SetBurst(10)
+	rl.AddZoneItem(defaultKey)
+	if err := rl.GetContext(context.Background(), defaultKey); err != nil {
+		t.Fatalf("First request failed unexpectedly: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	if err := rl.GetContext(ctx, defaultKey); err != context.Canceled {
+		t.Errorf("Expected context canceled, got: %v", err)
+	}
+	v, _ := rl.(*zoneRateLimiter).zoneMap.Load(defaultKey)
+	if excess := v.bucket.(*limiterRecord).load().excess; excess >= int64(time.Second/time.Millisecond) {
+		t.Errorf("The slot is not given back, excess: %d", excess)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := rl.GetContext(ctx, defaultKey); !errors.Is(err, ErrRejected) {
+		t.Errorf("Expected rejection, got: %v", err)
+	}
+	if err := rl.GetContext(ctx, noExistKey); err != nil {
+		t.Errorf("Expected no limit for key: %v, got: %v", noExistKey, err)
+	}
+}
+
+//the zone's rate limit to 1000 req/s, burst is 10, driven by a fake clock
+//for the key customizedKey, its overwrited rate is set to 100, burst is 10, nodelay to false,
+//1,000 reqs of each key are supposed to be finished in exact 1 and 10 seconds of the fake clock
+func TestZoneFakeClockRate(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1661990400, 0))
+	rl := NewZoneRateLimiter(1000, WithClock(clock)).SetBurst(10).SetResolution(ResolutionEnum.Microsecond)
+	rl.AddZoneItem(defaultKey)
+	rl.SetZoneItem(customizedKey, 100, 10, false)
+
+	for key, expected := range map[interface{}]time.Duration{
+		defaultKey:    999 * time.Millisecond,
+		customizedKey: 9990 * time.Millisecond,
+	} {
+		start := clock.Now()
+		for i := 0; i < 1000; i++ {
+			delay, err := rl.GetDelayInMicroseconds(key)
+			if err != nil {
+				t.Fatalf("Request %d of key %v is rejected unexpectedly: %v", i, key, err)
+			}
+			clock.Advance(time.Duration(delay) * time.Microsecond)
+		}
+		if elapsed := clock.Now().Sub(start); elapsed != expected {
+			t.Errorf("Key %v finished unexpectedly in %v", key, elapsed)
+		}
+	}
+}
+
+//the zone's rate limit to 1000 req/s, burst is 100, driven by a fake clock
+//a batch of n requests is supposed to take the same time span as n single requests
+func TestZoneGetDelayN(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1661990400, 0))
+	rl := NewZoneRateLimiter(1000, WithClock(clock)).SetBurst(100)
+	rl.AddZoneItem(defaultKey)
+	if _, err := rl.GetDelayInMicrosecondsN(defaultKey, 101); !errors.Is(err, ErrRejected) {
+		t.Errorf("Expected rejection for a batch larger than burst, got: %v", err)
+	}
+	if _, err := rl.GetDelayInMicrosecondsN(noExistKey, 101); err != nil {
+		t.Errorf("Expected no limit for key: %v, got: %v", noExistKey, err)
+	}
+	start := clock.Now()
+	for i := 0; i < 100; i++ {
+		delay, err := rl.GetDelayInMicrosecondsN(defaultKey, 100)
+		if err != nil {
+			t.Fatalf("Batch %d is rejected unexpectedly: %v", i, err)
+		}
+		clock.Advance(time.Duration(delay) * time.Microsecond)
+	}
+	if elapsed := clock.Now().Sub(start); elapsed != 9999*time.Millisecond {
+		t.Errorf("Finished unexpectedly in %v", elapsed)
+	}
+}
+
+//the zone's rate limit to 100 req/s, burst is 10, driven by a fake clock
+//it is expected that a cancelled reservation of a key gives its water back to the key's bucket
+func TestZoneReservation(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1661990400, 0))
+	rl := NewZoneRateLimiter(100, WithClock(clock)).SetBurst(10)
+	rl.AddZoneItem(defaultKey)
+	rl.Get(defaultKey)
+
+	for i := 0; i < 3; i++ {
+		r := rl.ReserveN(defaultKey, 10)
+		if !r.OK() || r.Delay() != 100*time.Millisecond {
+			t.Fatalf("Unexpected reservation: %v, %v", r.OK(), r.Delay())
+		}
+		r.Cancel()
+	}
+	if r := rl.Reserve(defaultKey); !r.OK() || r.Delay() != 10*time.Millisecond {
+		t.Errorf("Unexpected reservation: %v, %v", r.OK(), r.Delay())
+	}
+	if r := rl.ReserveN(defaultKey, 10); r.OK() {
+		t.Errorf("Expected a rejected reservation")
+	}
+	if r := rl.ReserveN(noExistKey, 100); !r.OK() || r.Delay() != 0 {
+		t.Errorf("Expected no limit for key: %v", noExistKey)
+	}
+}
+
+//the zone's rate limit to 1000 req/s, burst is 100, driven by a fake clock
+//64 routines are racing for the bucket of a key while others reserve and cancel,
+//it is expected that the output rate stays exact, run it with -race
+func TestZoneStressExactRate(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1661990400, 0))
+	rl := NewZoneRateLimiter(1000, WithClock(clock)).SetBurst(100).SetResolution(ResolutionEnum.Microsecond)
+	rl.AddZoneItem(defaultKey)
+	getDelay := func() (int64, error) {
+		return rl.GetDelayInMicroseconds(defaultKey)
+	}
+
+	checkDelays(t, stressDelays(getDelay, 64, 10), 101, 0, 1000)
+	for i := 0; i < 20; i++ {
+		clock.Advance(10 * time.Millisecond)
+		delays := stressDelays(func() (int64, error) {
+			//a cancelled reservation leaves no trace in the bucket
+			rl.ReserveN(defaultKey, 2).Cancel()
+			return getDelay()
+		}, 64, 10)
+		checkDelays(t, delays, 10, 91000, 1000)
+	}
+}
+
+//the zone's rate limit to 100 req/s, burst is 10, driven by a fake clock
+//it is expected that the settings of an existing key are replaced with its water level kept
+func TestZoneReconfigure(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1661990400, 0))
+	rl := NewZoneRateLimiter(100, WithClock(clock)).SetBurst(10)
+	rl.AddZoneItem(defaultKey)
+	rl.Get(defaultKey)
+	rl.GetDelayInMicrosecondsN(defaultKey, 5)
+
+	rl.SetZoneItem(defaultKey, 200, 20, false)
+	rl.SetResolution(ResolutionEnum.Microsecond)
+	if delay, err := rl.GetDelayInMicrosecondsN(defaultKey, 10); delay != 75000 || err != nil {
+		t.Errorf("Unexpected delay: %d, %v", delay, err)
+	}
+	if err := rl.AddZoneItem(defaultKey); err == nil {
+		t.Errorf("Expected an error for an existing key")
+	}
+
+	//the new settings of the zone only take effect for the keys added later
+	rl.SetRate(10).SetBurst(0)
+	rl.AddZoneItem(noExistKey)
+	rl.Get(noExistKey)
+	if _, err := rl.GetDelayInMicroseconds(noExistKey); err == nil {
+		t.Errorf("Expected rejection for key: %v", noExistKey)
+	}
+	if _, err := rl.GetDelayInMicroseconds(defaultKey); err != nil {
+		t.Errorf("Unexpected rejection for key: %v", defaultKey)
+	}
+}
+
+type tenantKey struct {
+	tenant string
+	region int
+}
+
+//the zone's rate limit to 100 req/s, burst is 10, keyed by a struct type, driven by a fake clock
+//it is expected to work the same as the zone rate limiter of interface{} keys
+func TestZoneOf(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1661990400, 0))
+	rl := NewZoneRateLimiterOf[tenantKey](100, WithClock(clock)).SetBurst(10)
+	key := tenantKey{defaultKey, 1}
+	rl.AddZoneItem(key)
+	rl.SetZoneItem(tenantKey{defaultKey, 2}, 10, 0, true)
+
+	for i := 0; i <= 10; i++ {
+		if delay, err := rl.GetDelayInMicroseconds(key); delay != int64(i)*10000 || err != nil {
+			t.Errorf("Unexpected delay of request %d: %d, %v", i, delay, err)
+		}
+	}
+	if _, err := rl.GetDelayInMicroseconds(key); !errors.Is(err, ErrRejected) {
+		t.Errorf("Expected rejection, got: %v", err)
+	}
+	if err := rl.Get(tenantKey{defaultKey, 2}); err != nil {
+		t.Errorf("Unexpected rejection: %v", err)
+	}
+	if err := rl.Get(tenantKey{defaultKey, 2}); !errors.Is(err, ErrRejected) {
+		t.Errorf("Expected rejection, got: %v", err)
+	}
+	if delay, err := rl.GetDelayInMicrosecondsN(tenantKey{noExistKey, 1}, 100); delay != 0 || err != nil {
+		t.Errorf("Expected no limit for a none-exist key, got: %d, %v", delay, err)
+	}
+
+	if err := rl.DeleteZoneItem(key); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if err := rl.DeleteZoneItem(key); err == nil {
+		t.Errorf("Expected an error for a none-exist key")
+	}
+	if _, err := rl.GetDelayInMicroseconds(key); err != nil {
+		t.Errorf("Expected no limit for a deleted key, got: %v", err)
+	}
+}
+
+//the zone's rate limit to 100 req/s, burst is 10, driven by a fake clock
+//it is expected that the requests of the unknown keys are treated according to the policy
+func TestUnknownKeyPolicy(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1661990400, 0))
+	rl := NewZoneRateLimiter(100, WithClock(clock)).SetBurst(10)
+	rl.AddZoneItem(defaultKey)
+
+	rl.SetUnknownKeyPolicy(UnknownKeyPolicyEnum.Deny)
+	_, err := rl.GetDelayInMicroseconds(noExistKey)
+	if !errors.Is(err, ErrRejected) || !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Expected rejection of an unknown key, got: %v", err)
+	}
+	if err := rl.GetContext(context.Background(), noExistKey); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Expected rejection of an unknown key, got: %v", err)
+	}
+	if err := rl.Get(defaultKey); err != nil {
+		t.Errorf("Unexpected rejection of a known key: %v", err)
+	}
+
+	rl.SetUnknownKeyPolicy(UnknownKeyPolicyEnum.Allow)
+	if _, err := rl.GetDelayInMicrosecondsN(noExistKey, 100); err != nil {
+		t.Errorf("Expected no limit for an unknown key, got: %v", err)
+	}
+
+	//the concurrent first requests of an unknown key share the same bucket
+	rl.SetUnknownKeyPolicy(UnknownKeyPolicyEnum.Create).SetBurst(100)
+	delays := stressDelays(func() (int64, error) {
+		return rl.GetDelayInMicroseconds(noExistKey)
+	}, 64, 10)
+	checkDelays(t, delays, 101, 0, 10000)
+	if err := rl.AddZoneItem(noExistKey); err == nil {
+		t.Errorf("Expected the unknown key to be added")
+	}
+}
+
+//the zone's rate limit to 1 req/s, burst is 10, nodelay, the idle ttl is 1 second, driven by a fake clock
+//only the items of the default settings, idle for 1 second and holding no water are expected to be evicted
+func TestIdleEviction(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1661990400, 0))
+	rl := NewZoneRateLimiterOf[string](1, WithClock(clock)).SetBurst(10).SetNodelay(true).
+		SetUnknownKeyPolicy(UnknownKeyPolicyEnum.Create).SetIdleTTL(time.Second)
+	z := rl.(*zoneRateLimiterOf[string])
+	rl.Get("drained")
+	rl.AddZoneItem("added")
+	rl.Get("customized")
+	rl.SetZoneItem("customized", 100, 10, true)
+	//1 req/s, the bucket holds water for 10 seconds,
+	//Note: the water of the first request leaks out at once since an empty bucket is regarded as having been idle
+	rl.Get("full")
+	if err := rl.GetN("full", 10); err != nil {
+		t.Fatalf("Unexpected rejection: %v", err)
+	}
+
+	clock.Advance(500 * time.Millisecond)
+	if n := z.evictIdle(); n != 0 {
+		t.Errorf("Expected no eviction before the ttl, got %d", n)
+	}
+	clock.Advance(500 * time.Millisecond)
+	rl.Get("new")
+	clock.Advance(100 * time.Millisecond)
+	if n := z.evictIdle(); n != 2 {
+		t.Errorf("Expected 2 items evicted, got %d", n)
+	}
+	for key, expected := range map[string]bool{"drained": false, "added": false, "customized": true, "full": true, "new": true} {
+		if _, ok := z.zoneMap.Load(key); ok != expected {
+			t.Errorf("Key %s is expected to be kept: %v", key, expected)
+		}
+	}
+	//the bucket holding water is kept, so the limit can not be bypassed
+	if _, err := rl.GetDelayInMicrosecondsN("full", 2); !errors.Is(err, ErrRejected) {
+		t.Errorf("Expected rejection, got: %v", err)
+	}
+
+	clock.Advance(10 * time.Second)
+	if n := z.evictIdle(); n != 2 || rl.Len() != 1 {
+		t.Errorf("Expected 2 items evicted and the customized key kept, got %d evicted, %d kept", n, rl.Len())
+	}
+	//an evicted key is regarded as a key never added
+	if err := rl.GetN("full", 10); err != nil {
+		t.Errorf("Unexpected rejection: %v", err)
+	}
+
+	//the item evicted but not removed from the zone yet is replaced by a new one
+	rl.Get("stale")
+	clock.Advance(time.Second)
+	stale, _ := z.zoneMap.Load("stale")
+	if !stale.evictIdle(stale.loadMeta(), z.nanotime(), time.Second) {
+		t.Fatalf("Expected the item to be evicted")
+	}
+	if err := rl.Get("stale"); err != nil {
+		t.Errorf("Unexpected rejection: %v", err)
+	}
+	if v, _ := z.zoneMap.Load("stale"); v == stale || v.bucket.(*limiterRecord).load().resolution == 0 {
+		t.Errorf("Expected a new item taking the request")
+	}
+}
+
+//the janitor evicts the idle items every 100 milliseconds, driven by a fake clock
+func TestJanitor(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1661990400, 0))
+	rl := NewZoneRateLimiter(100, WithClock(clock)).SetBurst(10).
+		SetUnknownKeyPolicy(UnknownKeyPolicyEnum.Create).SetIdleTTL(time.Second)
+	rl.SetZoneItem(customizedKey, 100, 10, false)
+	rl.StartJanitor(100 * time.Millisecond)
+	rl.StartJanitor(100 * time.Millisecond)
+	//the janitor waits on a single timer, it sweeps once the timer fires and then waits again
+	waitTimer := func() {
+		for clock.Waiters() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	waitTimer()
+	if _, err := rl.GetDelayInMicroseconds(defaultKey); err != nil {
+		t.Errorf("Unexpected rejection: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		clock.Advance(100 * time.Millisecond)
+		waitTimer()
+	}
+	if _, err := rl.GetDelayInMicroseconds(defaultKey); err != nil || rl.Len() != 2 {
+		t.Errorf("Expected the key to be kept, got: %v, %d keys", err, rl.Len())
+	}
+	for i := 0; i < 11; i++ {
+		clock.Advance(100 * time.Millisecond)
+		waitTimer()
+	}
+	//the key created on first use is evicted, while the key customized explicitly is kept
+	if _, ok := rl.(*zoneRateLimiter).zoneMap.Load(customizedKey); !ok || rl.Len() != 1 {
+		t.Errorf("Expected the key to be evicted, got %d keys", rl.Len())
+	}
+	if clock.Waiters() != 1 {
+		t.Errorf("Expected a single janitor, got %d timers", clock.Waiters())
+	}
+	rl.Close()
+	rl.Close()
+	if clock.Waiters() != 0 {
+		t.Errorf("Expected the janitor to be stopped, got %d timers", clock.Waiters())
+	}
+}
+
+//the zone holds at most 3 keys created on first use, rate limit to 100 req/s, burst is 10, nodelay, driven by a fake clock
+//the least recently used key holding no water is expected to be evicted for a new key
+func TestMaxEntriesEvictLRU(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1661990400, 0))
+	rl := NewZoneRateLimiterOf[string](100, WithClock(clock)).SetBurst(10).SetNodelay(true).
+		SetUnknownKeyPolicy(UnknownKeyPolicyEnum.Create).SetMaxEntries(3)
+	z := rl.(*zoneRateLimiterOf[string])
+	//Note: the water of the first request leaks out at once since an empty bucket is regarded as having been idle
+	rl.Get("a")
+	rl.Get("a")
+	rl.Get("b")
+	clock.Advance(time.Millisecond)
+	rl.Get("c")
+	if err := rl.Get("d"); err != nil {
+		t.Fatalf("Unexpected rejection: %v", err)
+	}
+	for key, expected := range map[string]bool{"a": true, "b": false, "c": true, "d": true} {
+		if _, ok := z.zoneMap.Load(key); ok != expected {
+			t.Errorf("Key %s is expected to be kept: %v", key, expected)
+		}
+	}
+	if rl.Len() != 3 {
+		t.Errorf("Expected 3 entries, got %d", rl.Len())
+	}
+
+	//no key can be evicted while all of them hold water
+	rl.Get("c")
+	rl.Get("d")
+	_, err := rl.GetDelayInMicroseconds("e")
+	if !errors.Is(err, ErrRejected) || !errors.Is(err, ErrZoneFull) {
+		t.Errorf("Expected rejection of a full zone, got: %v", err)
+	}
+	if err := rl.AddZoneItem("e"); !errors.Is(err, ErrZoneFull) {
+		t.Errorf("Expected the key not to be added, got: %v", err)
+	}
+	clock.Advance(10 * time.Millisecond)
+	if err := rl.AddZoneItem("e"); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if rl.Len() != 3 {
+		t.Errorf("Expected 3 entries, got %d", rl.Len())
+	}
+}
+
+//the zone holds at most 1000 keys created on first use, rate limit to 100 req/s, burst is 10, nodelay, driven by a fake clock
+//100 keys used recently are expected to survive the eviction for 100 new keys, since the LRU key is taken from the samples
+func TestMaxEntriesEvictSampled(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1661990400, 0))
+	rl := NewZoneRateLimiterOf[int](100, WithClock(clock)).SetBurst(10).SetNodelay(true).
+		SetUnknownKeyPolicy(UnknownKeyPolicyEnum.Create).SetMaxEntries(1000)
+	z := rl.(*zoneRateLimiterOf[int])
+	for key := 0; key < 1000; key++ {
+		rl.GetDelayInMicroseconds(key)
+	}
+	clock.Advance(time.Second)
+	for key := 0; key < 100; key++ {
+		rl.GetDelayInMicroseconds(key)
+	}
+	clock.Advance(time.Second)
+	for key := 1000; key < 1100; key++ {
+		if _, err := rl.GetDelayInMicroseconds(key); err != nil {
+			t.Fatalf("Unexpected rejection of key %d: %v", key, err)
+		}
+	}
+	for key := 0; key < 100; key++ {
+		if _, ok := z.zoneMap.Load(key); !ok {
+			t.Errorf("Expected the recently used key %d to be kept", key)
+		}
+	}
+	if rl.Len() != 1000 || len(z.lru.items) != 1000 {
+		t.Errorf("Expected 1000 entries, got %d entries, %d candidates", rl.Len(), len(z.lru.items))
+	}
+}
+
+//64 routines create 1000 keys concurrently in a zone of at most 50 keys, while some keys are deleted or customized,
+//with both the sync.Map and the sharded store, it is expected that the LRU candidates are exactly the keys created on first use
+func TestStressEvictLRU(t *testing.T) {
+	for _, opts := range [][]Option{nil, {WithShards(16)}} {
+		rl := NewZoneRateLimiterOf[int](100, opts...).SetBurst(10).
+			SetUnknownKeyPolicy(UnknownKeyPolicyEnum.Create).SetMaxEntries(50)
+		z := rl.(*zoneRateLimiterOf[int])
+		var next int64
+		wg := sync.WaitGroup{}
+		wg.Add(64)
+		for i := 0; i < 64; i++ {
+			go func() {
+				defer wg.Done()
+				for key := int(atomic.AddInt64(&next, 1)); key <= 1000; key = int(atomic.AddInt64(&next, 1)) {
+					rl.GetDelayInMicroseconds(key)
+					switch key % 10 {
+					case 0:
+						rl.DeleteZoneItem(key - 1)
+					case 5:
+						rl.SetZoneItem(key-1, 100, 10, false)
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		created := 0
+		z.zoneMap.Range(func(key int, item *zoneItem) bool {
+			if item.defaults == 1 {
+				created++
+				if c := z.lru.items[item.slot-1]; item.slot == 0 || c.item != item || c.key != key {
+					t.Errorf("Key %d is not an LRU candidate", key)
+				}
+			}
+			return true
+		})
+		if created != len(z.lru.items) || created > 50 {
+			t.Errorf("Expected %d LRU candidates, got %d", created, len(z.lru.items))
+		}
+	}
+}
+
+//the keys added or customized explicitly, rate limit to 1 req/s, burst is 0, idle for the ttl, driven by a fake clock
+//it is expected that the customized key is never evicted, so it is neither locked out, unlimited, nor reset to the defaults,
+//while the added key of the default settings is evicted only with the Create policy, which creates it again
+func TestIdleEvictionExplicitKeys(t *testing.T) {
+	for _, policy := range []UnknownKeyPolicy{UnknownKeyPolicyEnum.Allow, UnknownKeyPolicyEnum.Deny, UnknownKeyPolicyEnum.Create} {
+		clock := NewFakeClock(time.Unix(1661990400, 0))
+		rl := NewZoneRateLimiter(100, WithClock(clock)).SetBurst(10).SetNodelay(true).
+			SetUnknownKeyPolicy(policy).SetIdleTTL(time.Second).SetMaxEntries(2)
+		rl.SetZoneItem("vip", 1, 0, false)
+		rl.AddZoneItem("tenant")
+		clock.Advance(2 * time.Second)
+		expected := 0
+		if policy == UnknownKeyPolicyEnum.Create {
+			expected = 1
+		}
+		if n := rl.(*zoneRateLimiter).evictIdle(); n != expected {
+			t.Errorf("Policy %d: expected %d evicted, got %d", policy, expected, n)
+		}
+		if rl.(*zoneRateLimiter).evictLRU() {
+			t.Errorf("Policy %d: expected no eviction for a new key", policy)
+		}
+		accepted := 0
+		for i := 0; i < 3; i++ {
+			if _, err := rl.GetDelayInMicroseconds("vip"); err == nil {
+				accepted++
+			}
+		}
+		if _, err := rl.GetDelayInMicroseconds("tenant"); accepted != 1 || err != nil {
+			t.Errorf("Policy %d: expected 1 req of vip accepted and tenant limited, got %d, %v", policy, accepted, err)
+		}
+	}
+}
+
+//the zone holds at most 2 keys, rate limit to 100 req/s, burst is 1, nodelay, driven by a fake clock
+func TestMaxEntriesOverflow(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1661990400, 0))
+	rl := NewZoneRateLimiter(100, WithClock(clock)).SetBurst(1).SetNodelay(true).
+		SetUnknownKeyPolicy(UnknownKeyPolicyEnum.Create).SetMaxEntries(2).SetOverflowPolicy(OverflowPolicyEnum.Reject)
+	rl.AddZoneItem(defaultKey)
+	rl.Get(customizedKey)
+	if _, err := rl.GetDelayInMicroseconds(noExistKey); !errors.Is(err, ErrZoneFull) {
+		t.Errorf("Expected rejection of a full zone, got: %v", err)
+	}
+	rl.DeleteZoneItem(customizedKey)
+	if _, err := rl.GetDelayInMicroseconds(noExistKey); err != nil {
+		t.Errorf("Unexpected rejection: %v", err)
+	}
+	//the customized keys are not limited by the max entries
+	rl.SetZoneItem(customizedKey, 100, 1, true)
+	if rl.Len() != 3 {
+		t.Errorf("Expected 3 entries, got %d", rl.Len())
+	}
+
+	//the new keys share a single bucket, the third request is expected to be rejected
+	rl.SetOverflowPolicy(OverflowPolicyEnum.Shared)
+	for i, key := range []interface{}{"shared1", "shared2", "shared2"} {
+		_, err := rl.GetDelayInMicroseconds(key)
+		if expected := i < 2; (err == nil) != expected {
+			t.Errorf("Request %d of key %v is expected to be accepted: %v, got: %v", i, key, expected, err)
+		}
+	}
+	if rl.Len() != 3 {
+		t.Errorf("Expected 3 entries, got %d", rl.Len())
+	}
+}
+
+//64 routines create 1000 keys concurrently in a zone of at most 50 keys, with both the sync.Map and the sharded store
+//it is expected that exactly 50 keys are created
+func TestStressMaxEntries(t *testing.T) {
+	for _, opts := range [][]Option{nil, {WithShards(16)}} {
+		rl := NewZoneRateLimiterOf[int](100, opts...).SetBurst(10).
+			SetUnknownKeyPolicy(UnknownKeyPolicyEnum.Create).SetMaxEntries(50).SetOverflowPolicy(OverflowPolicyEnum.Reject)
+		var accepted int64
+		var next int64
+		wg := sync.WaitGroup{}
+		wg.Add(64)
+		for i := 0; i < 64; i++ {
+			go func() {
+				defer wg.Done()
+				for key := atomic.AddInt64(&next, 1); key <= 1000; key = atomic.AddInt64(&next, 1) {
+					if _, err := rl.GetDelayInMicroseconds(int(key)); err == nil {
+						atomic.AddInt64(&accepted, 1)
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		if accepted != 50 || rl.Len() != 50 {
+			t.Errorf("Expected 50 keys, got %d accepted, %d entries", accepted, rl.Len())
+		}
+	}
+}
+
+//the sharded store is expected to find the equal keys of any comparable type in the same shard
+func TestShardedStore(t *testing.T) {
+	rl := NewZoneRateLimiter(100, WithShards(10)).SetBurst(10)
+	store := rl.(*zoneRateLimiter).zoneMap.(*shardedStore[interface{}])
+	if len(store.shards) != 16 {
+		t.Errorf("Expected 16 shards, got %d", len(store.shards))
+	}
+	keys := []interface{}{defaultKey, customizedKey, int64(2022), tenantKey{"tenant", 1}, [2]float64{0, 1}}
+	for _, key := range keys {
+		if err := rl.AddZoneItem(key); err != nil {
+			t.Errorf("Unexpected error of key %v: %v", key, err)
+		}
+	}
+	negativeZero := math.Copysign(0, -1)
+	for _, key := range []interface{}{defaultKey, customizedKey, int64(2022), tenantKey{"tenant", 1}, [2]float64{negativeZero, 1}} {
+		if err := rl.AddZoneItem(key); err == nil {
+			t.Errorf("Expected key %v to exist", key)
+		}
+	}
+	visited := 0
+	store.Range(func(key interface{}, item *zoneItem) bool {
+		visited++
+		//the keys can be deleted while ranging over them, the entries are counted by the zone rather than the store
+		return store.CompareAndDelete(key, item)
+	})
+	if visited != len(keys) || rl.Len() != len(keys) {
+		t.Errorf("Expected %d keys, visited %d, got %d entries", len(keys), visited, rl.Len())
+	}
+	if _, ok := store.Load(defaultKey); ok {
+		t.Errorf("Expected the keys to be deleted")
+	}
+}
+
+//benchmarkZoneChurn runs the mixed load on a zone whose keys are constantly added and deleted,
+//each routine gets, adds and deletes the keys at the ratio of 8:1:1
+func benchmarkZoneChurn(b *testing.B, opts ...Option) {
+	rl := NewZoneRateLimiterOf[int](1000000, opts...).SetBurst(100).SetUnknownKeyPolicy(UnknownKeyPolicyEnum.Create)
+	var seed int64
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		//a simple xorshift generator for the keys of each routine
+		x := uint64(atomic.AddInt64(&seed, 1)) * 0x9E3779B97F4A7C15
+		for i := 0; pb.Next(); i++ {
+			x ^= x << 13
+			x ^= x >> 7
+			x ^= x << 17
+			key := int(x % (1 << 16))
+			switch i % 10 {
+			case 0:
+				rl.AddZoneItem(key)
+			case 1:
+				rl.DeleteZoneItem(key)
+			default:
+				rl.GetDelayInMicroseconds(key)
+			}
+		}
+	})
+}
+
+func BenchmarkZoneChurnSyncMap(b *testing.B) {
+	benchmarkZoneChurn(b)
+}
+
+func BenchmarkZoneChurnSharded(b *testing.B) {
+	benchmarkZoneChurn(b, WithShards(64))
+}
+
+//the zone's rate limit to 10 req/s, burst is 5, delay is 2, and the customized key of delay 4, driven by a fake clock
+//the excess reqs of each key are expected to pass without delay up to its delay setting
+func TestZoneDelayN(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1661990400, 0))
+	rl := NewZoneRateLimiter(10, WithClock(clock)).SetBurst(5).SetDelay(2)
+	rl.AddZoneItem(defaultKey)
+	rl.SetZoneItem(customizedKey, 10, 5, false, WithDelay(4))
+
+	for key, expected := range map[interface{}][]int64{
+		defaultKey:    {0, 0, 0, 100000, 200000, 300000},
+		customizedKey: {0, 0, 0, 0, 0, 100000},
+	} {
+		for i, e := range expected {
+			if delay, err := rl.GetDelayInMicroseconds(key); err != nil || delay != e {
+				t.Errorf("Unexpected delay of request %d of key %v: %d, %v", i, key, delay, err)
+			}
+		}
+		if _, err := rl.GetDelayInMicroseconds(key); !errors.Is(err, ErrRejected) {
+			t.Errorf("Expected rejection of key %v, got: %v", key, err)
+		}
+	}
+}
+
+//hashKeyOf is a key of the struct type with a blank field, a float, an interface and an array
+type hashKeyOf struct {
+	id    int
+	_     int32
+	score float64
+	tag   interface{}
+	path  [2]string
+}
+
+//the equal keys of the types hashed by reflection, including the blank fields, +0 and -0, and the interface fields
+//it is expected that they have the same hash both by maphash.Comparable and by reflection for the legacy toolchains
+func TestHashKey(t *testing.T) {
+	seed := maphash.MakeSeed()
+	a := hashKeyOf{id: 1, tag: "vip", path: [2]string{"a", "b"}}
+	b := hashKeyOf{id: 1, score: math.Copysign(0, -1), tag: "vip", path: [2]string{"a", "b"}}
+	//the blank field is ignored by ==, while it holds a different value
+	*(*int32)(unsafe.Add(unsafe.Pointer(&b), reflect.TypeOf(b).Field(1).Offset)) = 7
+	pointer := new(int)
+	for _, c := range []struct{ a, b interface{} }{
+		{a, b},
+		{complex(0, 1), complex(math.Copysign(0, -1), 1)},
+		{struct{ p *int }{pointer}, struct{ p *int }{pointer}},
+		{[2]interface{}{1, "x"}, [2]interface{}{1, "x"}},
+	} {
+		if c.a != c.b {
+			t.Fatalf("Expected the keys to be equal: %v, %v", c.a, c.b)
+		}
+		if hashKey(seed, c.a) != hashKey(seed, c.b) || reflectHashKey(seed, c.a) != reflectHashKey(seed, c.b) {
+			t.Errorf("Expected the same hash of the equal keys: %+v, %+v", c.a, c.b)
+		}
+	}
+	if hashKey(seed, a) != hashKey(seed, b) || reflectHashKey(seed, a) != reflectHashKey(seed, b) {
+		t.Errorf("Expected the same hash of the equal keys of the generic type: %+v, %+v", a, b)
+	}
+	if reflectHashKey(seed, a) == reflectHashKey(seed, hashKeyOf{id: 2}) {
+		t.Errorf("Expected a different hash of a different key")
+	}
+}
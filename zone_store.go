@@ -0,0 +1,182 @@
+package ratelimit
+
+/*
+Copyright (c) Yunpeng Deng(dypflying)
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+import (
+	"hash/maphash"
+	"sync"
+)
+
+//zoneStore holds the items of a zone rate limiter by the keys
+type zoneStore[K comparable] interface {
+	Load(key K) (*zoneItem, bool)
+	//return the existing item of the key, or store the given one
+	LoadOrStore(key K, item *zoneItem) (*zoneItem, bool)
+	LoadAndDelete(key K) (*zoneItem, bool)
+	//delete the key only if it holds the given item
+	CompareAndDelete(key K, item *zoneItem) bool
+	//call f for each key until it returns false, f may delete the keys
+	Range(f func(key K, item *zoneItem) bool)
+}
+
+//newZoneStore returns a sharded store if the shards are set, or a sync.Map store
+func newZoneStore[K comparable](shards int) zoneStore[K] {
+	if shards > 1 {
+		return newShardedStore[K](shards)
+	}
+	return &syncMapStore[K]{}
+}
+
+//syncMapStore is the default store, sync.Map is tuned for the read-mostly and stable keys
+type syncMapStore[K comparable] struct {
+	m sync.Map
+}
+
+func (s *syncMapStore[K]) Load(key K) (*zoneItem, bool) {
+	if v, ok := s.m.Load(key); ok {
+		return v.(*zoneItem), true
+	}
+	return nil, false
+}
+
+func (s *syncMapStore[K]) LoadOrStore(key K, item *zoneItem) (*zoneItem, bool) {
+	v, loaded := s.m.LoadOrStore(key, item)
+	return v.(*zoneItem), loaded
+}
+
+func (s *syncMapStore[K]) LoadAndDelete(key K) (*zoneItem, bool) {
+	if v, ok := s.m.LoadAndDelete(key); ok {
+		return v.(*zoneItem), true
+	}
+	return nil, false
+}
+
+func (s *syncMapStore[K]) CompareAndDelete(key K, item *zoneItem) bool {
+	return s.m.CompareAndDelete(key, item)
+}
+
+func (s *syncMapStore[K]) Range(f func(key K, item *zoneItem) bool) {
+	s.m.Range(func(key, v interface{}) bool {
+		return f(key.(K), v.(*zoneItem))
+	})
+}
+
+//shardedStore partitions the keys by hash into the shards of plain maps guarded by their own locks,
+//it suits the keys which are constantly added and deleted
+type shardedStore[K comparable] struct {
+	seed   maphash.Seed
+	mask   uint64
+	shards []zoneShard[K]
+}
+
+type zoneShard[K comparable] struct {
+	mu    sync.RWMutex
+	items map[K]*zoneItem
+	//keep the locks of the adjacent shards off the same cache line
+	_ [32]byte
+}
+
+//newShardedStore is the constructor for a sharded store, the number of shards is rounded up to a power of 2
+func newShardedStore[K comparable](shards int) *shardedStore[K] {
+	n := 1
+	for n < shards {
+		n <<= 1
+	}
+	s := &shardedStore[K]{
+		seed:   maphash.MakeSeed(),
+		mask:   uint64(n - 1),
+		shards: make([]zoneShard[K], n),
+	}
+	for i := range s.shards {
+		s.shards[i].items = make(map[K]*zoneItem)
+	}
+	return s
+}
+
+func (s *shardedStore[K]) shard(key K) *zoneShard[K] {
+	return &s.shards[hashKey(s.seed, key)&s.mask]
+}
+
+func (s *shardedStore[K]) Load(key K) (*zoneItem, bool) {
+	shard := s.shard(key)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	item, ok := shard.items[key]
+	return item, ok
+}
+
+func (s *shardedStore[K]) LoadOrStore(key K, item *zoneItem) (*zoneItem, bool) {
+	shard := s.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	if actual, ok := shard.items[key]; ok {
+		return actual, true
+	}
+	shard.items[key] = item
+	return item, false
+}
+
+func (s *shardedStore[K]) LoadAndDelete(key K) (*zoneItem, bool) {
+	shard := s.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	item, ok := shard.items[key]
+	if ok {
+		delete(shard.items, key)
+	}
+	return item, ok
+}
+
+func (s *shardedStore[K]) CompareAndDelete(key K, item *zoneItem) bool {
+	shard := s.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	if actual, ok := shard.items[key]; ok && actual == item {
+		delete(shard.items, key)
+		return true
+	}
+	return false
+}
+
+//Range visits a snapshot of each shard, so f is called without holding the lock
+func (s *shardedStore[K]) Range(f func(key K, item *zoneItem) bool) {
+	type entry struct {
+		key  K
+		item *zoneItem
+	}
+	var entries []entry
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.mu.RLock()
+		entries = entries[:0]
+		for key, item := range shard.items {
+			entries = append(entries, entry{key, item})
+		}
+		shard.mu.RUnlock()
+		for _, e := range entries {
+			if !f(e.key, e.item) {
+				return
+			}
+		}
+	}
+}